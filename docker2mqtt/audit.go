@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// A publishedMessage knows the client which published it.
+// MQTT does not forward the client ID of the publisher to the subscribers, so only the messages received through the embedded broker know it.
+type publishedMessage interface {
+	publisher() (clientID string, remoteAddr string)
+}
+
+// auditRecord is a command received, the client ID and remote address of the publisher are only known with the embedded broker
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	Topic      string    `json:"topic"`
+	Payload    string    `json:"payload"`
+	ClientID   string    `json:"client_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Container  string    `json:"container,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+}
+
+// auditLog appends every command received to a JSON-lines file and mirrors it to <topic>/audit
+type auditLog struct {
+	mutex      sync.Mutex
+	file       *os.File
+	mqttClient mqtt.Client
+	topic      string
+}
+
+// openAuditLog opens the audit file for appending, if file is empty the records are only sent to MQTT
+func openAuditLog(file string, mqttClient mqtt.Client, topic string) (*auditLog, error) {
+	audit := &auditLog{mqttClient: mqttClient, topic: topic}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		audit.file = f
+	}
+	return audit, nil
+}
+
+func (audit *auditLog) record(record auditRecord) {
+	record.Result = "ok"
+	if record.Error != "" {
+		record.Result = "error"
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode the audit record: %v\n", err)
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file != nil {
+		if _, err := audit.file.Write(append(line, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write the audit record: %v\n", err)
+		}
+	}
+	audit.mqttClient.Publish(audit.topic+"/audit", 1, false, line)
+}
+
+// An auditedHandler handles a command received from MQTT and returns the containers it applied to
+type auditedHandler func(client mqtt.Client, msg mqtt.Message) ([]string, error)
+
+// handler returns a MQTT handler recording every message received along with the outcome of the handler
+func (audit *auditLog) handler(handler auditedHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		start := time.Now()
+		containers, err := handler(client, msg)
+		record := auditRecord{
+			Time:      start,
+			Source:    "mqtt",
+			Topic:     msg.Topic(),
+			Payload:   string(msg.Payload()),
+			Container: strings.Join(containers, ","),
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if published, ok := msg.(publishedMessage); ok {
+			record.ClientID, record.RemoteAddr = published.publisher()
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		audit.record(record)
+	}
+}
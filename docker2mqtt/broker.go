@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// mqttBroker is the embedded MQTT broker, running inside the bridge.
+// The bridge subscribes to its commands directly on the broker, so that it knows which client published every command.
+type mqttBroker struct {
+	server        *mochi.Server
+	mutex         sync.Mutex
+	subscriptions int
+}
+
+// brokerMessage is a message received through a subscription on the embedded broker
+type brokerMessage struct {
+	packet     packets.Packet
+	remoteAddr string
+}
+
+func (msg brokerMessage) Duplicate() bool   { return msg.packet.FixedHeader.Dup }
+func (msg brokerMessage) Qos() byte         { return msg.packet.FixedHeader.Qos }
+func (msg brokerMessage) Retained() bool    { return msg.packet.FixedHeader.Retain }
+func (msg brokerMessage) Topic() string     { return msg.packet.TopicName }
+func (msg brokerMessage) MessageID() uint16 { return msg.packet.PacketID }
+func (msg brokerMessage) Payload() []byte   { return msg.packet.Payload }
+func (msg brokerMessage) Ack()              {}
+
+func (msg brokerMessage) publisher() (string, string) {
+	return msg.packet.Origin, msg.remoteAddr
+}
+
+// A subscriber subscribes a handler to the messages published on a topic filter
+type subscriber func(filter string, handler mqtt.MessageHandler)
+
+// mqttSubscriber subscribes through the MQTT client
+func mqttSubscriber(mqttClient mqtt.Client) subscriber {
+	return func(filter string, handler mqtt.MessageHandler) {
+		mqttClient.Subscribe(filter, 1, handler).Wait()
+	}
+}
+
+// subscriber subscribes directly on the broker, the handlers are given mqttClient to publish their responses.
+// They are called by the connection of the publisher, so the messages of different clients are handled concurrently.
+func (broker *mqttBroker) subscriber(mqttClient mqtt.Client) subscriber {
+	return func(filter string, handler mqtt.MessageHandler) {
+		broker.mutex.Lock()
+		broker.subscriptions++
+		id := broker.subscriptions
+		broker.mutex.Unlock()
+		err := broker.server.Subscribe(filter, id, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+			msg := brokerMessage{packet: pk}
+			if publisher, ok := broker.server.Clients.Get(pk.Origin); ok {
+				msg.remoteAddr = publisher.Net.Remote
+			}
+			handler(mqttClient, msg)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to subscribe to %s on the embedded broker: %v\n", filter, err)
+		}
+	}
+}
+
+func (broker *mqttBroker) Close() error {
+	return broker.server.Close()
+}
+
+// startEmbeddedBroker starts an MQTT broker inside the bridge, listening on address.
+// If authFile is set, it must contain the users and ACLs (in the YAML or JSON ledger format of the broker), otherwise anonymous access is allowed.
+// If dataFile is set, sessions and retained messages are persisted to it.
+// It returns the URL the bridge should use to connect to the broker.
+func startEmbeddedBroker(address string, authFile string, dataFile string) (*mqttBroker, string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid address %q: %v", address, err)
+	}
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	if authFile != "" {
+		data, err := os.ReadFile(authFile)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to read the auth file: %v", err)
+		}
+		if err := server.AddHook(new(auth.Hook), &auth.Options{Data: data}); err != nil {
+			return nil, "", fmt.Errorf("unable to load the auth file: %v", err)
+		}
+	} else {
+		if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+			return nil, "", err
+		}
+	}
+	if dataFile != "" {
+		if err := server.AddHook(new(bolt.Hook), &bolt.Options{Path: dataFile}); err != nil {
+			return nil, "", fmt.Errorf("unable to open the data file: %v", err)
+		}
+	}
+
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})); err != nil {
+		return nil, "", fmt.Errorf("unable to listen on %s: %v", address, err)
+	}
+	go func() {
+		if err := server.Serve(); err != nil {
+			fmt.Fprintf(os.Stderr, "Embedded MQTT broker stopped: %v\n", err)
+		}
+	}()
+
+	// The bridge itself connects through the loopback interface
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return &mqttBroker{server: server}, "tcp://" + net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// The maximum stop timeout accepted in a command, in seconds
+const maxStopTimeout = 3600
+
+var signalFormat = regexp.MustCompile(`^([A-Z][A-Z0-9+-]*|[0-9]+)$`)
+
+// commandOptions are the options given to a command, not every command accepts every option
+type commandOptions struct {
+	Timeout    *int   `json:"timeout,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	Dependents *bool  `json:"dependents,omitempty"`
+}
+
+// A command is an action that can be run on a container, from MQTT or from the HTTP API
+type command struct {
+	acceptsTimeout    bool
+	acceptsSignal     bool
+	acceptsDependents bool
+	run               func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error
+}
+
+// stopOptions leaves the timeout unset when none is given, so that docker uses the container's own stop timeout
+func stopOptions(options commandOptions) container.StopOptions {
+	return container.StopOptions{Timeout: options.Timeout, Signal: options.Signal}
+}
+
+var commands = map[string]command{
+	"restart": {acceptsTimeout: true, acceptsSignal: true, acceptsDependents: true, run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		if options.Dependents != nil && *options.Dependents {
+			return restartWithDependents(dockerContext, dockerClient, []string{id}, options)
+		}
+		return dockerClient.ContainerRestart(dockerContext, id, stopOptions(options))
+	}},
+	"start": {run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		return dockerClient.ContainerStart(dockerContext, id, container.StartOptions{})
+	}},
+	"stop": {acceptsTimeout: true, acceptsSignal: true, run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		return dockerClient.ContainerStop(dockerContext, id, stopOptions(options))
+	}},
+	"kill": {acceptsSignal: true, run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		signal := "SIGKILL"
+		if options.Signal != "" {
+			signal = options.Signal
+		}
+		return dockerClient.ContainerKill(dockerContext, id, signal)
+	}},
+	"pause": {run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		return dockerClient.ContainerPause(dockerContext, id)
+	}},
+	"unpause": {run: func(dockerContext context.Context, dockerClient *client.Client, id string, options commandOptions) error {
+		return dockerClient.ContainerUnpause(dockerContext, id)
+	}},
+}
+
+// validate checks that the options are accepted by the named command and have sensible values
+func (options commandOptions) validate(name string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	if options.Timeout != nil {
+		if !cmd.acceptsTimeout {
+			return fmt.Errorf("the %s command does not accept a timeout", name)
+		}
+		if *options.Timeout < 0 || *options.Timeout > maxStopTimeout {
+			return fmt.Errorf("invalid timeout %d, it must be between 0 and %d seconds", *options.Timeout, maxStopTimeout)
+		}
+	}
+	if options.Signal != "" {
+		if !cmd.acceptsSignal {
+			return fmt.Errorf("the %s command does not accept a signal", name)
+		}
+		if !signalFormat.MatchString(options.Signal) {
+			return fmt.Errorf("invalid signal %q", options.Signal)
+		}
+	}
+	if options.Dependents != nil && !cmd.acceptsDependents {
+		return fmt.Errorf("the %s command does not accept dependents", name)
+	}
+	return nil
+}
+
+// withDefaults returns the options, completed with the defaults for the options not given
+func (options commandOptions) withDefaults(defaults commandOptions) commandOptions {
+	if options.Timeout == nil {
+		options.Timeout = defaults.Timeout
+	}
+	if options.Signal == "" {
+		options.Signal = defaults.Signal
+	}
+	if options.Dependents == nil {
+		options.Dependents = defaults.Dependents
+	}
+	return options
+}
+
+// runCommand runs the named command on the container id
+func runCommand(dockerContext context.Context, dockerClient *client.Client, name string, id string, options commandOptions) error {
+	if err := options.validate(name); err != nil {
+		return err
+	}
+	return commands[name].run(dockerContext, dockerClient, id, options)
+}
+
+// stringList is a list of strings which can be given as a single JSON string too
+type stringList []string
+
+func (list *stringList) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*list = stringList{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*list = values
+	return nil
+}
+
+// containerSelector selects the containers a request applies to, with either a plain container name or ID, or a JSON object like:
+//
+//	{"name": ["web", "db"], "id": "3f2a", "service": "myproject/worker", "label": "tier=batch,env"}
+//
+// The request applies to every container matching at least one of the selectors.
+// A service is a compose service, optionally prefixed by its compose project.
+// A label selector is a comma separated list of key=value or key, all of them must match.
+type containerSelector struct {
+	Container string     `json:"-"`
+	Names     stringList `json:"name,omitempty"`
+	IDs       stringList `json:"id,omitempty"`
+	Services  stringList `json:"service,omitempty"`
+	Labels    stringList `json:"label,omitempty"`
+}
+
+func (selector containerSelector) empty() bool {
+	return selector.Container == "" && len(selector.Names)+len(selector.IDs)+len(selector.Services)+len(selector.Labels) == 0
+}
+
+// commandRequest is the payload of a command, the selectors can be given along with the options, like:
+//
+//	{"service": "myproject/worker", "timeout": 10, "signal": "SIGINT"}
+type commandRequest struct {
+	containerSelector
+	commandOptions
+}
+
+// parseCommandRequest decodes and validates the payload of the named command
+func parseCommandRequest(name string, payload []byte) (commandRequest, error) {
+	var request commandRequest
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			return request, fmt.Errorf("invalid JSON payload: %v", err)
+		}
+	} else {
+		request.Container = string(trimmed)
+	}
+	if request.empty() {
+		return request, fmt.Errorf("no container given")
+	}
+	return request, request.validate(name)
+}
+
+func matchLabels(labels map[string]string, selector string) bool {
+	for _, term := range strings.Split(selector, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(term), "=")
+		actual, ok := labels[key]
+		if !ok || (hasValue && actual != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the IDs of the selected containers
+func (selector containerSelector) resolve(dockerContext context.Context, dockerClient *client.Client) ([]string, error) {
+	if selector.Container != "" {
+		// Docker resolves the names and the IDs by itself
+		return []string{selector.Container}, nil
+	}
+
+	containers, err := dockerClient.ContainerList(dockerContext, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]bool)
+	for _, name := range selector.Names {
+		found := false
+		for _, c := range containers {
+			for _, n := range c.Names {
+				if strings.TrimPrefix(n, "/") == name {
+					selected[c.ID] = true
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no container named %q", name)
+		}
+	}
+	for _, prefix := range selector.IDs {
+		var matches []string
+		for _, c := range containers {
+			if strings.HasPrefix(c.ID, prefix) {
+				matches = append(matches, c.ID)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no container with an ID starting with %q", prefix)
+		}
+		if len(matches) > 1 {
+			return nil, fmt.Errorf("ambiguous ID prefix %q matches %d containers", prefix, len(matches))
+		}
+		selected[matches[0]] = true
+	}
+	for _, service := range selector.Services {
+		project, service, hasProject := strings.Cut(service, "/")
+		if !hasProject {
+			project, service = "", project
+		}
+		for _, c := range containers {
+			if c.Labels["com.docker.compose.service"] == service && (!hasProject || c.Labels["com.docker.compose.project"] == project) {
+				selected[c.ID] = true
+			}
+		}
+	}
+	for _, labels := range selector.Labels {
+		for _, c := range containers {
+			if matchLabels(c.Labels, labels) {
+				selected[c.ID] = true
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no container matches the selectors")
+	}
+
+	// Keep the order of the docker list to be predictable
+	var ids []string
+	for _, c := range containers {
+		if selected[c.ID] {
+			ids = append(ids, c.ID)
+		}
+	}
+	return ids, nil
+}
+
+// executeCommand runs the named command on every container selected by the request and returns them
+func executeCommand(dockerContext context.Context, dockerClient *client.Client, name string, request commandRequest) ([]string, error) {
+	ids, err := request.resolve(dockerContext, dockerClient)
+	if err != nil {
+		return nil, err
+	}
+	if name == "restart" && request.Dependents != nil && *request.Dependents {
+		// The dependents shared by the selected containers are restarted once, after all of them
+		if err := request.commandOptions.validate(name); err != nil {
+			return nil, err
+		}
+		return ids, restartWithDependents(dockerContext, dockerClient, ids, request.commandOptions)
+	}
+	var errs []error
+	for _, id := range ids {
+		if err := runCommand(dockerContext, dockerClient, name, id, request.commandOptions); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", id, err))
+		}
+	}
+	return ids, errors.Join(errs...)
+}
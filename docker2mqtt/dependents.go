@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+)
+
+// The delay during which the restart events of the containers restarted along with their dependents are ignored
+const restartTrackingDelay = 2 * time.Minute
+
+// restartTracker remembers the containers for which something happened recently
+type restartTracker struct {
+	mutex  sync.Mutex
+	marked map[string]time.Time
+}
+
+// recentRestarts are the containers whose dependents were just restarted, so that their own restart events do not restart them again
+var recentRestarts = &restartTracker{marked: make(map[string]time.Time)}
+
+// recentDeaths are the containers which just died, so that starting them again is seen as a restart, like with a restart policy
+var recentDeaths = &restartTracker{marked: make(map[string]time.Time)}
+
+func (tracker *restartTracker) mark(id string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.markLocked(id)
+}
+
+func (tracker *restartTracker) markLocked(id string) {
+	now := time.Now()
+	for other, at := range tracker.marked {
+		if now.Sub(at) > restartTrackingDelay {
+			delete(tracker.marked, other)
+		}
+	}
+	tracker.marked[id] = now
+}
+
+func (tracker *restartTracker) recent(id string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	at, ok := tracker.marked[id]
+	return ok && time.Since(at) <= restartTrackingDelay
+}
+
+// markUnlessRecent marks the container and returns true, unless it was already marked recently
+func (tracker *restartTracker) markUnlessRecent(id string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if at, ok := tracker.marked[id]; ok && time.Since(at) <= restartTrackingDelay {
+		return false
+	}
+	tracker.markLocked(id)
+	return true
+}
+
+type dependencyInfo struct {
+	id        string
+	name      string
+	dependsOn []string
+}
+
+// dependencies returns the containers the given one depends on, as IDs, names or compose services, through:
+//   - network_mode: container:<name or ID>
+//   - links
+//   - the compose depends_on label
+func dependencies(hostConfig *container.HostConfig, labels map[string]string) []string {
+	var dependsOn []string
+	if hostConfig != nil {
+		if hostConfig.NetworkMode.IsContainer() {
+			dependsOn = append(dependsOn, hostConfig.NetworkMode.ConnectedContainer())
+		}
+		for _, link := range hostConfig.Links {
+			source, _, _ := strings.Cut(link, ":")
+			dependsOn = append(dependsOn, strings.TrimPrefix(source, "/"))
+		}
+	}
+	// The label looks like "vpn:service_started:true,db:service_healthy:false"
+	if project, ok := labels["com.docker.compose.project"]; ok {
+		for _, dependency := range strings.Split(labels["com.docker.compose.depends_on"], ",") {
+			if service, _, _ := strings.Cut(dependency, ":"); service != "" {
+				dependsOn = append(dependsOn, "service:"+project+"/"+service)
+			}
+		}
+	}
+	return dependsOn
+}
+
+// findDependents returns the running containers depending, directly or not, on any of the containers ids, which are not part of them.
+// They are ordered so that every container comes after the containers it depends on.
+func findDependents(dockerContext context.Context, dockerClient *client.Client, ids []string) ([]dependencyInfo, error) {
+	containers, err := dockerClient.ContainerList(dockerContext, container.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// The names under which every container can be referenced
+	aliases := make(map[string][]string)
+	infos := make(map[string]dependencyInfo)
+	selected := make(map[string]bool)
+	var names []string
+	for _, id := range ids {
+		root, err := dockerClient.ContainerInspect(dockerContext, id)
+		if err != nil {
+			return nil, err
+		}
+		aliases[root.ID] = containerAliases(root.ID, root.Name, root.Config.Labels)
+		selected[root.ID] = true
+		names = append(names, strings.TrimPrefix(root.Name, "/"))
+	}
+	for _, c := range containers {
+		if selected[c.ID] {
+			continue
+		}
+		info, err := dockerClient.ContainerInspect(dockerContext, c.ID)
+		if err != nil {
+			continue
+		}
+		dependency := dependencyInfo{id: info.ID, name: strings.TrimPrefix(info.Name, "/")}
+		dependency.dependsOn = dependencies(info.HostConfig, info.Config.Labels)
+		infos[info.ID] = dependency
+		aliases[info.ID] = containerAliases(info.ID, info.Name, info.Config.Labels)
+	}
+
+	matches := func(reference string, id string) bool {
+		for _, alias := range aliases[id] {
+			if reference == alias || (len(reference) >= 12 && strings.HasPrefix(id, reference)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Find the dependents, level by level
+	roots := len(selected)
+	for changed := true; changed; {
+		changed = false
+		for id, info := range infos {
+			if selected[id] {
+				continue
+			}
+			for _, reference := range info.dependsOn {
+				for other := range selected {
+					if matches(reference, other) {
+						selected[id] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	// Order them: a container is ready once all the selected containers it depends on are
+	var ordered []dependencyInfo
+	done := make(map[string]bool)
+	for id := range selected {
+		done[id] = true
+	}
+	for len(ordered) < len(selected)-roots {
+		progress := false
+		for id, info := range infos {
+			if !selected[id] || done[id] {
+				continue
+			}
+			ready := true
+			for _, reference := range info.dependsOn {
+				for other := range selected {
+					if !done[other] && other != id && matches(reference, other) {
+						ready = false
+					}
+				}
+			}
+			if ready {
+				ordered = append(ordered, info)
+				done[id] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("circular dependency between the dependents of %s", strings.Join(names, ", "))
+		}
+	}
+	return ordered, nil
+}
+
+func containerAliases(id string, name string, labels map[string]string) []string {
+	aliases := []string{id, strings.TrimPrefix(name, "/")}
+	if service, ok := labels["com.docker.compose.service"]; ok {
+		aliases = append(aliases, "service:"+labels["com.docker.compose.project"]+"/"+service)
+	}
+	return aliases
+}
+
+// restartWithDependents restarts the containers ids, then the containers depending on them.
+// A container depending on several of them, or being one of them, is restarted only once.
+func restartWithDependents(dockerContext context.Context, dockerClient *client.Client, ids []string, options commandOptions) error {
+	var restarted []string
+	var errs []error
+	for _, id := range ids {
+		info, err := dockerClient.ContainerInspect(dockerContext, id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", id, err))
+			continue
+		}
+		recentRestarts.mark(info.ID)
+		if err := dockerClient.ContainerRestart(dockerContext, info.ID, stopOptions(options)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", id, err))
+			continue
+		}
+		restarted = append(restarted, info.ID)
+	}
+	if len(restarted) > 0 {
+		if err := restartDependents(dockerContext, dockerClient, restarted, options); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restartDependents restarts the containers depending on the containers ids, in order
+func restartDependents(dockerContext context.Context, dockerClient *client.Client, ids []string, options commandOptions) error {
+	dependents, err := findDependents(dockerContext, dockerClient, ids)
+	if err != nil {
+		return err
+	}
+	for _, dependent := range dependents {
+		recentRestarts.mark(dependent.id)
+	}
+	for _, dependent := range dependents {
+		fmt.Printf("Restarting container %s, which depends on %s\n", dependent.name, strings.Join(ids, ", "))
+		if err := dockerClient.ContainerRestart(dockerContext, dependent.id, stopOptions(options)); err != nil {
+			return fmt.Errorf("unable to restart the dependent container %s: %v", dependent.name, err)
+		}
+	}
+	return nil
+}
+
+// handleRestartEvent restarts the dependents of a container restarted outside of the bridge, either explicitly
+// or by docker itself after it died, like with a restart policy: docker then sends a start event following the die event, but no restart event
+func handleRestartEvent(dockerContext context.Context, dockerClient *client.Client, msg events.Message) {
+	if msg.Type != events.ContainerEventType {
+		return
+	}
+	id := msg.Actor.ID
+	switch msg.Action {
+	case events.ActionDie:
+		recentDeaths.mark(id)
+		return
+	case events.ActionStart:
+		if !recentDeaths.recent(id) {
+			return
+		}
+	case events.ActionRestart:
+	default:
+		return
+	}
+	// A docker restart sends die, start and restart, the dependents are restarted only once
+	if !recentRestarts.markUnlessRecent(id) {
+		return
+	}
+	go func() {
+		if err := restartDependents(dockerContext, dockerClient, []string{id}, commandOptions{}); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to restart the dependents of container %s: %v\n", id, err)
+		}
+	}()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// The maximum size of stdout and stderr sent back for an exec request
+const maxExecOutput = 64 * 1024
+
+// The default and maximum time in seconds given to an exec request, a timeout of 0 uses the default
+const defaultExecTimeout = 30
+const maxExecTimeout = 3600
+
+// diagnosticRequest is the payload of the inspect and exec requests, a plain container name or ID is accepted for inspect
+type diagnosticRequest struct {
+	ID            string   `json:"id,omitempty"`
+	Container     string   `json:"container"`
+	ResponseTopic string   `json:"response_topic,omitempty"`
+	Fields        []string `json:"fields,omitempty"`
+	Cmd           []string `json:"cmd,omitempty"`
+	User          string   `json:"user,omitempty"`
+	WorkingDir    string   `json:"workdir,omitempty"`
+	Env           []string `json:"env,omitempty"`
+	Timeout       int      `json:"timeout,omitempty"`
+}
+
+type diagnosticResponse struct {
+	ID        string         `json:"id,omitempty"`
+	Container string         `json:"container"`
+	Error     string         `json:"error,omitempty"`
+	Inspect   any            `json:"inspect,omitempty"`
+	Fields    map[string]any `json:"fields,omitempty"`
+	ExitCode  *int           `json:"exit_code,omitempty"`
+	Stdout    string         `json:"stdout,omitempty"`
+	Stderr    string         `json:"stderr,omitempty"`
+}
+
+func parseDiagnosticRequest(payload []byte) (diagnosticRequest, error) {
+	var request diagnosticRequest
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &request); err != nil {
+			return request, fmt.Errorf("invalid JSON payload: %v", err)
+		}
+	} else {
+		request.Container = string(trimmed)
+	}
+	if request.Container == "" {
+		return request, fmt.Errorf("no container given")
+	}
+	return request, nil
+}
+
+// replyTopic returns the topic to reply to: the default one, or the one given in the request if it is below the default one,
+// so that a request cannot make the bridge publish on its command topics or on the topics of other devices
+func replyTopic(request diagnosticRequest, defaultTopic string) (string, error) {
+	if request.ResponseTopic == "" {
+		return defaultTopic, nil
+	}
+	if !strings.HasPrefix(request.ResponseTopic, defaultTopic+"/") || strings.ContainsAny(request.ResponseTopic, "+#") {
+		return defaultTopic, fmt.Errorf("invalid response topic %q, it must be below %s", request.ResponseTopic, defaultTopic)
+	}
+	return request.ResponseTopic, nil
+}
+
+func publishResponse(client mqtt.Client, topic string, response diagnosticResponse) {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode the response: %v\n", err)
+		return
+	}
+	client.Publish(topic, 1, false, payload)
+}
+
+// selectField returns the value at the dotted path (like State.Health.Status) of the decoded JSON
+func selectField(value any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// inspectHandler replies with the result of ContainerInspect, or only the requested fields of it, on defaultResponseTopic or below it
+func inspectHandler(client mqtt.Client, msg mqtt.Message, dockerClient *client.Client, dockerContext context.Context, defaultResponseTopic string) ([]string, error) {
+	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	request, err := parseDiagnosticRequest(msg.Payload())
+	responseTopic, topicErr := replyTopic(request, defaultResponseTopic)
+	if err == nil {
+		err = topicErr
+	}
+	response := diagnosticResponse{ID: request.ID, Container: request.Container}
+	if err != nil {
+		response.Error = err.Error()
+		publishResponse(client, responseTopic, response)
+		return nil, err
+	}
+
+	_, raw, err := dockerClient.ContainerInspectWithRaw(dockerContext, request.Container, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to inspect container %s: %v\n", request.Container, err)
+		response.Error = err.Error()
+		publishResponse(client, responseTopic, response)
+		return []string{request.Container}, err
+	}
+	var inspect any
+	if err := json.Unmarshal(raw, &inspect); err != nil {
+		response.Error = err.Error()
+		publishResponse(client, responseTopic, response)
+		return []string{request.Container}, err
+	}
+	if len(request.Fields) == 0 {
+		response.Inspect = inspect
+	} else {
+		response.Fields = make(map[string]any, len(request.Fields))
+		for _, field := range request.Fields {
+			if value, ok := selectField(inspect, field); ok {
+				response.Fields[field] = value
+			} else {
+				response.Fields[field] = nil
+			}
+		}
+	}
+	publishResponse(client, responseTopic, response)
+	return []string{request.Container}, nil
+}
+
+// execHandler runs a command in a container carrying the allowed label and replies with its output and exit code, on defaultResponseTopic or below it
+func execHandler(client mqtt.Client, msg mqtt.Message, dockerClient *client.Client, dockerContext context.Context, defaultResponseTopic string, label string) ([]string, error) {
+	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	request, err := parseDiagnosticRequest(msg.Payload())
+	responseTopic, topicErr := replyTopic(request, defaultResponseTopic)
+	if err == nil {
+		err = topicErr
+	}
+	response := diagnosticResponse{ID: request.ID, Container: request.Container}
+	if err == nil && len(request.Cmd) == 0 {
+		err = fmt.Errorf("no command given")
+	}
+	if err == nil && (request.Timeout < 0 || request.Timeout > maxExecTimeout) {
+		err = fmt.Errorf("invalid timeout %d, it must be between 0 and %d seconds", request.Timeout, maxExecTimeout)
+	}
+	if err == nil {
+		response.ExitCode, response.Stdout, response.Stderr, err = execCommand(dockerClient, dockerContext, request, label)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to exec in container %s: %v\n", request.Container, err)
+		response.Error = err.Error()
+	}
+	publishResponse(client, responseTopic, response)
+	return []string{request.Container}, err
+}
+
+func execCommand(dockerClient *client.Client, dockerContext context.Context, request diagnosticRequest, label string) (*int, string, string, error) {
+	info, err := dockerClient.ContainerInspect(dockerContext, request.Container)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if info.Config == nil || info.Config.Labels[label] != "true" {
+		return nil, "", "", fmt.Errorf("exec is not allowed on this container (label %s=true is missing)", label)
+	}
+
+	timeout := defaultExecTimeout
+	if request.Timeout > 0 {
+		timeout = request.Timeout
+	}
+	ctx, cancel := context.WithTimeout(dockerContext, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	exec, err := dockerClient.ContainerExecCreate(ctx, info.ID, container.ExecOptions{
+		Cmd:          request.Cmd,
+		User:         request.User,
+		WorkingDir:   request.WorkingDir,
+		Env:          request.Env,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	attach, err := dockerClient.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer attach.Close()
+
+	var stdout, stderr limitedBuffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(&stdout, &stderr, attach.Reader)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, "", "", err
+		}
+	case <-ctx.Done():
+		attach.Close()
+		<-done
+		return nil, stdout.String(), stderr.String(), fmt.Errorf("command timed out after %d seconds", timeout)
+	}
+
+	result, err := dockerClient.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return &result.ExitCode, stdout.String(), stderr.String(), nil
+}
+
+// limitedBuffer keeps the first maxExecOutput bytes written to it and drops the rest
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxExecOutput - buffer.Len(); room > 0 {
+		if len(p) > room {
+			buffer.Buffer.Write(p[:room])
+		} else {
+			buffer.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -4,44 +4,89 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/eclipse/paho.mqtt.golang"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/eclipse/paho.mqtt.golang"
 )
 
-func restartHandler(client mqtt.Client, msg mqtt.Message, dockerClient *client.Client, dockerContext context.Context) {
+func commandHandler(name string, defaults commandOptions, client mqtt.Client, msg mqtt.Message, dockerClient *client.Client, dockerContext context.Context) ([]string, error) {
 	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
-	var timeout = int(30*time.Second)
-	var options container.StopOptions
-	options.Timeout = &timeout
-	err := dockerClient.ContainerRestart(dockerContext, string(msg.Payload()), options)
+	request, err := parseCommandRequest(name, msg.Payload())
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to restart container %s: %v\n", msg.Payload(), err)
+		fmt.Fprintf(os.Stderr, "Invalid %s command %s: %v\n", name, msg.Payload(), err)
+		return nil, err
+	}
+	request.commandOptions = request.commandOptions.withDefaults(defaults)
+	ids, err := executeCommand(dockerContext, dockerClient, name, request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to %s container %s: %v\n", name, msg.Payload(), err)
 	} else {
-		fmt.Fprintf(os.Stdout, "Container %s restarted\n", msg.Payload())
+		fmt.Fprintf(os.Stdout, "Container %s: %s done\n", strings.Join(ids, ", "), name)
 	}
+	return ids, err
+}
+
+// eventJSON formats a docker event the way it is sent to MQTT and to the HTTP API
+func eventJSON(msg events.Message) string {
+	return fmt.Sprintf("{ \"time\": %d, \"type\": %q, \"name\": %q, \"action\": %q}", msg.Time, msg.Type, msg.Actor.Attributes["name"], msg.Action)
 }
 
 func main() {
 	// Handle interrupts to clean properly
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
 		select {
-			case sig := <-c:
-				fmt.Printf("Got %s signal. Aborting...\n", sig)
-				os.Exit(1)
+		case sig := <-c:
+			fmt.Printf("Got %s signal. Aborting...\n", sig)
+			os.Exit(1)
 		}
 	}()
 
 	// Load the parameters
 	var mqttServer = flag.String("mqtt-server", "tcp://localhost:1883", "The URL of the MQTT server to connecto to")
+	var mqttUsername = flag.String("mqtt-username", "", "The username to connect to the MQTT server with")
+	var mqttPassword = flag.String("mqtt-password", "", "The password to connect to the MQTT server with")
 	var mqttTopic = flag.String("mqtt-topic", "docker/events", "The MQTT topice to send the events to")
+	var output = flag.String("output", "json", "The comma separated list of formats to publish to MQTT: json (the raw events) and/or homie (the containers as Homie devices)")
+	var execLabel = flag.String("exec-label", "", "The label (set to true) allowing the commands received on the exec topic to run in a container, the exec topic is disabled if empty")
+	var rulesFile = flag.String("rules", "", "The JSON file containing the notification rules, no notification is sent if empty")
+	var restartDependents = flag.String("restart-dependents", "off", "When to restart the containers depending on a restarted container (through network_mode, links or compose depends_on): off, command (when restarted by the bridge) or auto (whenever restarted)")
+	var auditFile = flag.String("audit-file", "", "The file to append the JSON-lines audit log of the commands received to, the audit log is only sent to MQTT if empty")
+	var homieTopic = flag.String("homie-topic", "homie", "The MQTT base topic of the Homie devices")
+	var homieInterval = flag.Duration("homie-interval", 30*time.Second, "The interval between the updates of the CPU and memory usage of the Homie devices")
+	var embeddedBroker = flag.String("embedded-broker", "", "The address (like :1883) to run an embedded MQTT broker on, instead of connecting to the MQTT server")
+	var embeddedBrokerAuth = flag.String("embedded-broker-auth", "", "The file containing the users and ACLs of the embedded MQTT broker, anonymous access is allowed if empty")
+	var embeddedBrokerData = flag.String("embedded-broker-data", "", "The file to persist the sessions and retained messages of the embedded MQTT broker to, nothing is persisted if empty")
+	var httpServer = flag.String("http-server", "", "The address (like :8080) to serve the HTTP API on, the HTTP API is disabled if empty")
+	var httpToken = flag.String("http-token", "", "The bearer token the HTTP API clients must provide, no authentication if empty")
 	flag.Parse()
+	defaults := make(map[string]commandOptions)
+	switch *restartDependents {
+	case "off":
+	case "command", "auto":
+		dependents := true
+		defaults["restart"] = commandOptions{Dependents: &dependents}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown restart-dependents mode: %s\n", *restartDependents)
+		return
+	}
+	var jsonOutput, homieOutput bool
+	for _, format := range strings.Split(*output, ",") {
+		switch strings.TrimSpace(format) {
+		case "json":
+			jsonOutput = true
+		case "homie":
+			homieOutput = true
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown output format: %s\n", format)
+			return
+		}
+	}
 
 	// Connect to the docker socket
 	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
@@ -49,26 +94,120 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Unable to connect to docker: %v\n", err)
 		return
 	}
-	dockerContext, _ := context.WithCancel(context.Background())
+	dockerContext, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start the embedded MQTT broker
+	var broker *mqttBroker
+	if *embeddedBroker != "" {
+		var url string
+		broker, url, err = startEmbeddedBroker(*embeddedBroker, *embeddedBrokerAuth, *embeddedBrokerData)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start the embedded MQTT broker: %v\n", err)
+			return
+		}
+		defer broker.Close()
+		*mqttServer = url
+	}
 
 	// Connect to the MQTT server
 	opts := mqtt.NewClientOptions().AddBroker(*mqttServer)
+	if *mqttUsername != "" {
+		opts.SetUsername(*mqttUsername)
+		opts.SetPassword(*mqttPassword)
+	}
+	if homieOutput {
+		setHomieWill(opts, *homieTopic)
+	}
 	mqttClient := mqtt.NewClient(opts)
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to MQTT: %v\n", token.Error())
 		return
 	}
-	mqttClient.Subscribe(*mqttTopic + "/restart", 1, func(client mqtt.Client, msg mqtt.Message) { restartHandler(client, msg, dockerClient, dockerContext) }).Wait()
+	audit, err := openAuditLog(*auditFile, mqttClient, *mqttTopic)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open the audit file: %v\n", err)
+		return
+	}
+	// With the embedded broker, the commands are received directly from it to know their publisher
+	subscribe := mqttSubscriber(mqttClient)
+	if broker != nil {
+		subscribe = broker.subscriber(mqttClient)
+	}
+	for name := range commands {
+		subscribe(*mqttTopic+"/"+name, audit.handler(func(client mqtt.Client, msg mqtt.Message) ([]string, error) {
+			return commandHandler(name, defaults[name], client, msg, dockerClient, dockerContext)
+		}))
+	}
+	subscribe(*mqttTopic+"/inspect", audit.handler(func(client mqtt.Client, msg mqtt.Message) ([]string, error) {
+		return inspectHandler(client, msg, dockerClient, dockerContext, *mqttTopic+"/inspect/response")
+	}))
+	subscribe(*mqttTopic+"/update-resources", audit.handler(func(client mqtt.Client, msg mqtt.Message) ([]string, error) {
+		return updateResourcesHandler(client, msg, dockerClient, dockerContext, *mqttTopic)
+	}))
+	if *execLabel != "" {
+		handler := audit.handler(func(client mqtt.Client, msg mqtt.Message) ([]string, error) {
+			return execHandler(client, msg, dockerClient, dockerContext, *mqttTopic+"/exec/response", *execLabel)
+		})
+		// A command can run for up to an hour, run it aside so that the other messages are still handled
+		subscribe(*mqttTopic+"/exec", func(client mqtt.Client, msg mqtt.Message) {
+			go handler(client, msg)
+		})
+	}
+
+	// Publish the containers as Homie devices
+	var homie *homiePublisher
+	if homieOutput {
+		homie = newHomiePublisher(mqttClient, subscribe, dockerClient, dockerContext, *homieTopic, audit)
+		if err := homie.start(*homieInterval); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to publish the Homie devices: %v\n", err)
+			return
+		}
+	}
+
+	// Load the notification rules
+	var rules *rulesEngine
+	if *rulesFile != "" {
+		rules, err = loadRules(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load the rules: %v\n", err)
+			return
+		}
+	}
+
+	// Start the HTTP API
+	hub := newEventHub()
+	if *httpServer != "" {
+		if err := startHTTPServer(*httpServer, *httpToken, dockerClient, dockerContext, hub, defaults, audit); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to start the HTTP API: %v\n", err)
+			return
+		}
+	}
 
 	// Listen for events
-	msgs, errs := dockerClient.Events(dockerContext, types.EventsOptions{})
+	msgs, errs := dockerClient.Events(dockerContext, events.ListOptions{})
 	for {
 		select {
-			case err := <- errs:
-				fmt.Fprintf(os.Stderr, "Error while listening for docker events: %v\n", err)
+		case err := <-errs:
+			fmt.Fprintf(os.Stderr, "Error while listening for docker events: %v\n", err)
 
-			case msg := <-msgs:
-				mqttClient.Publish(*mqttTopic + "/events", 0, false, fmt.Sprintf("{ \"time\": %d, \"type\": %q, \"name\": %q, \"action\": %q}", msg.Time, msg.Type, msg.Actor.Attributes["name"], msg.Action))
+		case msg := <-msgs:
+			event := eventJSON(msg)
+			if jsonOutput {
+				mqttClient.Publish(*mqttTopic+"/events", 0, false, event)
+			}
+			// The state topics are published whatever the output formats are
+			handleStateEvent(mqttClient, *mqttTopic, dockerContext, dockerClient, msg)
+			if homie != nil {
+				homie.handleEvent(msg)
+			}
+			if rules != nil {
+				rules.handleEvent(msg)
+			}
+			if *restartDependents == "auto" {
+				handleRestartEvent(dockerContext, dockerClient, msg)
+			}
+			hub.publish(event)
 		}
 	}
 }
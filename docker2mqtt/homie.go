@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// homiePublisher publishes every container as a device following the Homie 4 convention (https://homieiot.github.io/specification/)
+type homiePublisher struct {
+	mqttClient    mqtt.Client
+	subscribe     subscriber
+	dockerClient  *client.Client
+	dockerContext context.Context
+	baseTopic     string
+	audit         *auditLog
+	mutex         sync.Mutex
+	devices       map[string]string // device ID -> container ID
+}
+
+// homieBridgeID is the device representing docker2mqtt itself, its $state is the MQTT will of the connection
+const homieBridgeID = "docker2mqtt"
+
+var homieInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// setHomieWill sets the will marking the bridge device as lost when the connection to the MQTT server is lost.
+// A client has a single will, so the container devices cannot be marked lost too: controllers should follow the bridge $state.
+func setHomieWill(opts *mqtt.ClientOptions, baseTopic string) {
+	opts.SetWill(baseTopic+"/"+homieBridgeID+"/$state", "lost", 1, true)
+}
+
+// homieDeviceID converts a container name into a valid Homie ID (lowercase letters, digits and hyphens)
+func homieDeviceID(name string) string {
+	return strings.Trim(homieInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+func newHomiePublisher(mqttClient mqtt.Client, subscribe subscriber, dockerClient *client.Client, dockerContext context.Context, baseTopic string, audit *auditLog) *homiePublisher {
+	return &homiePublisher{mqttClient: mqttClient, subscribe: subscribe, dockerClient: dockerClient, dockerContext: dockerContext, baseTopic: baseTopic, audit: audit, devices: make(map[string]string)}
+}
+
+// start publishes all the existing containers, subscribes to the settable properties and publishes the resources usage every interval
+func (homie *homiePublisher) start(interval time.Duration) error {
+	homie.publish(homieBridgeID, "$state", "init")
+	homie.publish(homieBridgeID, "$homie", "4.0")
+	homie.publish(homieBridgeID, "$name", "docker2mqtt")
+	homie.publish(homieBridgeID, "$extensions", "")
+	homie.publish(homieBridgeID, "$nodes", "")
+
+	containers, err := homie.dockerClient.ContainerList(homie.dockerContext, container.ListOptions{All: true})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		homie.refresh(c.ID)
+	}
+
+	setHandler := homie.audit.handler(func(client mqtt.Client, msg mqtt.Message) ([]string, error) { return homie.setHandler(msg) })
+	homie.subscribe(homie.baseTopic+"/+/container/running/set", setHandler)
+	homie.subscribe(homie.baseTopic+"/+/container/paused/set", setHandler)
+
+	go func() {
+		for range time.Tick(interval) {
+			homie.publishStats()
+		}
+	}()
+	homie.publish(homieBridgeID, "$state", "ready")
+	return nil
+}
+
+func (homie *homiePublisher) publish(deviceID string, path string, value string) {
+	homie.mqttClient.Publish(homie.baseTopic+"/"+deviceID+"/"+path, 1, true, value)
+}
+
+// publishDevice publishes the attributes describing the device, its node and its properties
+func (homie *homiePublisher) publishDevice(deviceID string, name string) {
+	homie.publish(deviceID, "$state", "init")
+	homie.publish(deviceID, "$homie", "4.0")
+	homie.publish(deviceID, "$name", name)
+	homie.publish(deviceID, "$extensions", "")
+	homie.publish(deviceID, "$nodes", "container")
+	homie.publish(deviceID, "container/$name", "Container")
+	homie.publish(deviceID, "container/$type", "docker")
+	homie.publish(deviceID, "container/$properties", "state,health,cpu,memory,running,paused")
+	properties := []struct {
+		id, name, datatype, format, unit string
+		settable                         bool
+	}{
+		{"state", "State", "enum", "created,running,paused,restarting,removing,exited,dead", "", false},
+		{"health", "Health", "enum", "none,starting,healthy,unhealthy", "", false},
+		{"cpu", "CPU usage", "float", "", "%", false},
+		{"memory", "Memory usage", "integer", "", "B", false},
+		{"running", "Running", "boolean", "", "", true},
+		{"paused", "Paused", "boolean", "", "", true},
+	}
+	for _, property := range properties {
+		homie.publish(deviceID, "container/"+property.id+"/$name", property.name)
+		homie.publish(deviceID, "container/"+property.id+"/$datatype", property.datatype)
+		if property.format != "" {
+			homie.publish(deviceID, "container/"+property.id+"/$format", property.format)
+		}
+		if property.unit != "" {
+			homie.publish(deviceID, "container/"+property.id+"/$unit", property.unit)
+		}
+		if property.settable {
+			homie.publish(deviceID, "container/"+property.id+"/$settable", "true")
+		}
+	}
+	homie.publish(deviceID, "$state", "ready")
+}
+
+// refresh publishes the current state of the container, publishing the device first if it is new
+func (homie *homiePublisher) refresh(id string) {
+	info, err := homie.dockerClient.ContainerInspect(homie.dockerContext, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to inspect container %s: %v\n", id, err)
+		return
+	}
+	name := strings.TrimPrefix(info.Name, "/")
+	deviceID := homieDeviceID(name)
+	if deviceID == "" || deviceID == homieBridgeID {
+		return
+	}
+
+	homie.mutex.Lock()
+	_, known := homie.devices[deviceID]
+	homie.devices[deviceID] = info.ID
+	homie.mutex.Unlock()
+	if !known {
+		homie.publishDevice(deviceID, name)
+	}
+
+	health := "none"
+	if info.State.Health != nil && info.State.Health.Status != "" {
+		health = info.State.Health.Status
+	}
+	homie.publish(deviceID, "container/state", info.State.Status)
+	homie.publish(deviceID, "container/health", health)
+	homie.publish(deviceID, "container/running", strconv.FormatBool(info.State.Running))
+	homie.publish(deviceID, "container/paused", strconv.FormatBool(info.State.Paused))
+	if !info.State.Running {
+		homie.publish(deviceID, "container/cpu", "0")
+		homie.publish(deviceID, "container/memory", "0")
+	}
+}
+
+// remove deletes the retained topics of a destroyed container
+func (homie *homiePublisher) remove(name string) {
+	deviceID := homieDeviceID(name)
+	if deviceID == homieBridgeID {
+		return
+	}
+	homie.mutex.Lock()
+	delete(homie.devices, deviceID)
+	homie.mutex.Unlock()
+	for _, path := range []string{"$homie", "$name", "$extensions", "$nodes", "$state", "container/$name", "container/$type", "container/$properties"} {
+		homie.publish(deviceID, path, "")
+	}
+	for _, property := range []string{"state", "health", "cpu", "memory", "running", "paused"} {
+		for _, attribute := range []string{"", "/$name", "/$datatype", "/$format", "/$unit", "/$settable"} {
+			homie.publish(deviceID, "container/"+property+attribute, "")
+		}
+	}
+}
+
+// handleEvent updates the devices after a docker event
+func (homie *homiePublisher) handleEvent(msg events.Message) {
+	if msg.Type != events.ContainerEventType {
+		return
+	}
+	switch {
+	case msg.Action == events.ActionDestroy:
+		homie.remove(msg.Actor.Attributes["name"])
+	case strings.HasPrefix(string(msg.Action), "exec_"):
+		// The state of the container does not change
+	default:
+		homie.refresh(msg.Actor.ID)
+	}
+}
+
+// setHandler maps the settable properties onto the docker commands
+func (homie *homiePublisher) setHandler(msg mqtt.Message) ([]string, error) {
+	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	parts := strings.Split(strings.TrimPrefix(msg.Topic(), homie.baseTopic+"/"), "/")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid topic %s", msg.Topic())
+	}
+	homie.mutex.Lock()
+	id, ok := homie.devices[parts[0]]
+	homie.mutex.Unlock()
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown Homie device %s\n", parts[0])
+		return nil, fmt.Errorf("unknown Homie device %s", parts[0])
+	}
+	value, err := strconv.ParseBool(string(msg.Payload()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid value %q for %s: %v\n", msg.Payload(), msg.Topic(), err)
+		return []string{parts[0]}, err
+	}
+
+	var name string
+	switch {
+	case parts[2] == "running" && value:
+		name = "start"
+	case parts[2] == "running" && !value:
+		name = "stop"
+	case parts[2] == "paused" && value:
+		name = "pause"
+	case parts[2] == "paused" && !value:
+		name = "unpause"
+	}
+	if err := runCommand(homie.dockerContext, homie.dockerClient, name, id, commandOptions{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to %s container %s: %v\n", name, parts[0], err)
+		// Publish the actual state back, as the value was not applied
+		homie.refresh(id)
+		return []string{parts[0]}, err
+	}
+	fmt.Fprintf(os.Stdout, "Container %s: %s done\n", parts[0], name)
+	return []string{parts[0]}, nil
+}
+
+// publishStats publishes the CPU and memory usage of the running containers
+func (homie *homiePublisher) publishStats() {
+	homie.mutex.Lock()
+	devices := make(map[string]string, len(homie.devices))
+	for deviceID, id := range homie.devices {
+		devices[deviceID] = id
+	}
+	homie.mutex.Unlock()
+
+	for deviceID, id := range devices {
+		reader, err := homie.dockerClient.ContainerStats(homie.dockerContext, id, false)
+		if err != nil {
+			continue
+		}
+		var stats container.StatsResponse
+		err = json.NewDecoder(reader.Body).Decode(&stats)
+		reader.Body.Close()
+		if err != nil || stats.Read.IsZero() || stats.MemoryStats.Usage == 0 {
+			// The container is not running
+			continue
+		}
+
+		var cpu float64
+		cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+		systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+		if cpuDelta > 0 && systemDelta > 0 {
+			cpus := float64(stats.CPUStats.OnlineCPUs)
+			if cpus == 0 {
+				cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+			}
+			cpu = cpuDelta / systemDelta * cpus * 100
+		}
+		// Like docker stats, the page cache is not counted as used memory
+		memory := stats.MemoryStats.Usage
+		if cache, ok := stats.MemoryStats.Stats["inactive_file"]; ok && cache < memory {
+			memory -= cache
+		} else if cache, ok := stats.MemoryStats.Stats["total_inactive_file"]; ok && cache < memory {
+			memory -= cache
+		}
+
+		homie.publish(deviceID, "container/cpu", strconv.FormatFloat(cpu, 'f', 2, 64))
+		homie.publish(deviceID, "container/memory", strconv.FormatUint(memory, 10))
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+)
+
+// eventHub dispatches the docker events to the HTTP clients listening to them
+type eventHub struct {
+	mutex       sync.Mutex
+	subscribers map[chan string]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: make(map[chan string]struct{})}
+}
+
+func (hub *eventHub) subscribe() chan string {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	ch := make(chan string, 16)
+	hub.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (hub *eventHub) unsubscribe(ch chan string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	delete(hub.subscribers, ch)
+}
+
+// publish sends the event to every subscriber, events are dropped for the subscribers too slow to read them
+func (hub *eventHub) publish(event string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+type httpServer struct {
+	dockerClient  *client.Client
+	dockerContext context.Context
+	token         string
+	events        *eventHub
+	defaults      map[string]commandOptions
+	audit         *auditLog
+}
+
+// startHTTPServer starts the HTTP API on address, if token is set it must be provided as a bearer token by the clients.
+// It returns an error if the address cannot be listened on.
+func startHTTPServer(address string, token string, dockerClient *client.Client, dockerContext context.Context, events *eventHub, defaults map[string]commandOptions, audit *auditLog) error {
+	server := &httpServer{dockerClient: dockerClient, dockerContext: dockerContext, token: token, events: events, defaults: defaults, audit: audit}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers", server.authenticated(server.containersHandler))
+	mux.HandleFunc("POST /containers/{name}/{command}", server.authenticated(server.commandHandler))
+	mux.HandleFunc("GET /events", server.authenticated(server.eventsHandler))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "HTTP server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func (server *httpServer) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.token != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing bearer token"})
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+func (server *httpServer) containersHandler(w http.ResponseWriter, r *http.Request) {
+	containers, err := server.dockerClient.ContainerList(r.Context(), container.ListOptions{All: true})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	states := make([]containerState, 0, len(containers))
+	for _, c := range containers {
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		states = append(states, containerState{ID: c.ID, Name: name, Image: c.Image, State: c.State, Status: c.Status, Created: c.Created, Labels: c.Labels})
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// commandHandler runs a command on the container, the options can be given as a JSON body like {"timeout": 10, "signal": "SIGINT", "dependents": true}
+func (server *httpServer) commandHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	name, cmd := r.PathValue("name"), r.PathValue("command")
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	status, err := server.runCommand(name, cmd, body)
+	record := auditRecord{
+		Time:       start,
+		Source:     "http",
+		Topic:      r.Method + " " + r.URL.Path,
+		Payload:    string(body),
+		RemoteAddr: r.RemoteAddr,
+		Container:  name,
+		Duration:   float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	server.audit.record(record)
+	if err != nil {
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"container": name, "command": cmd, "result": "ok"})
+}
+
+func (server *httpServer) runCommand(name string, cmd string, body []byte) (int, error) {
+	if _, ok := commands[cmd]; !ok {
+		return http.StatusNotFound, fmt.Errorf("unknown command %q", cmd)
+	}
+	var options commandOptions
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&options); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err)
+		}
+	}
+	if err := options.validate(cmd); err != nil {
+		return http.StatusBadRequest, err
+	}
+	options = options.withDefaults(server.defaults[cmd])
+	fmt.Printf("Received HTTP command: %s for container: %s\n", cmd, name)
+	if err := runCommand(server.dockerContext, server.dockerClient, cmd, name, options); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to %s container %s: %v\n", cmd, name, err)
+		if client.IsErrNotFound(err) {
+			return http.StatusNotFound, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	fmt.Fprintf(os.Stdout, "Container %s: %s done\n", name, cmd)
+	return http.StatusOK, nil
+}
+
+// eventsHandler streams the docker events as Server-Sent Events, with the same JSON as on MQTT
+func (server *httpServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := server.events.subscribe()
+	defer server.events.unsubscribe(ch)
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", event)
+			flusher.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
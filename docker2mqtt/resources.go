@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// The labels defining the resources policy of a container:
+//   - docker2mqtt.update-resources=true allows the updates
+//   - docker2mqtt.max-memory (like 2g) caps the memory limit
+//   - docker2mqtt.max-cpus (like 1.5) caps the number of CPUs, given as cpus or as cpu_quota / cpu_period
+//   - docker2mqtt.max-cpu-shares caps the CPU shares
+//   - docker2mqtt.restart-policies (like no,on-failure) lists the allowed restart policies
+const (
+	updateResourcesLabel = "docker2mqtt.update-resources"
+	maxMemoryLabel       = "docker2mqtt.max-memory"
+	maxCPUsLabel         = "docker2mqtt.max-cpus"
+	maxCPUSharesLabel    = "docker2mqtt.max-cpu-shares"
+	restartPoliciesLabel = "docker2mqtt.restart-policies"
+)
+
+// The limits enforced by docker itself, checked early to give clearer errors
+const (
+	minMemory        = 6 * 1024 * 1024
+	minCPUShares     = 2
+	minCPUPeriod     = 1000
+	maxCPUPeriod     = 1000000
+	defaultCPUPeriod = 100000
+	maxRetryCount    = 1000
+)
+
+// byteSize is a size in bytes, given as a number or as a string with a unit (like 512m or 2g)
+type byteSize int64
+
+func parseByteSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(value)), "b")
+	multiplier := float64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * multiplier), nil
+}
+
+func (size *byteSize) UnmarshalJSON(data []byte) error {
+	var number int64
+	if err := json.Unmarshal(data, &number); err == nil {
+		*size = byteSize(number)
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	number, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*size = byteSize(number)
+	return nil
+}
+
+type restartPolicy struct {
+	Name              string `json:"name"`
+	MaximumRetryCount int    `json:"max_retries,omitempty"`
+}
+
+// resourcesRequest is the payload of the update-resources command, like:
+//
+//	{"name": "batch", "memory": "512m", "cpus": 0.5, "restart_policy": {"name": "on-failure", "max_retries": 3}}
+type resourcesRequest struct {
+	containerSelector
+	Memory        *byteSize      `json:"memory,omitempty"`
+	MemorySwap    *byteSize      `json:"memory_swap,omitempty"`
+	CPUs          *float64       `json:"cpus,omitempty"`
+	CPUShares     *int64         `json:"cpu_shares,omitempty"`
+	CPUQuota      *int64         `json:"cpu_quota,omitempty"`
+	CPUPeriod     *int64         `json:"cpu_period,omitempty"`
+	RestartPolicy *restartPolicy `json:"restart_policy,omitempty"`
+}
+
+func parseResourcesRequest(payload []byte) (resourcesRequest, error) {
+	var request resourcesRequest
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return request, fmt.Errorf("invalid JSON payload: %v", err)
+	}
+	if request.empty() {
+		return request, fmt.Errorf("no container given")
+	}
+	if request.Memory == nil && request.MemorySwap == nil && request.CPUs == nil && request.CPUShares == nil && request.CPUQuota == nil && request.CPUPeriod == nil && request.RestartPolicy == nil {
+		return request, fmt.Errorf("no resource to update")
+	}
+
+	if request.Memory != nil && *request.Memory < minMemory {
+		return request, fmt.Errorf("invalid memory %d, the minimum is %d bytes", *request.Memory, minMemory)
+	}
+	if request.MemorySwap != nil && *request.MemorySwap != -1 && (request.Memory == nil || *request.MemorySwap < *request.Memory) {
+		return request, fmt.Errorf("invalid memory_swap, it must be -1 or greater than the memory given along")
+	}
+	if request.CPUs != nil && *request.CPUs <= 0 {
+		return request, fmt.Errorf("invalid cpus %g, it must be positive", *request.CPUs)
+	}
+	if request.CPUs != nil && (request.CPUQuota != nil || request.CPUPeriod != nil) {
+		return request, fmt.Errorf("cpus can not be given along with cpu_quota or cpu_period")
+	}
+	if request.CPUShares != nil && *request.CPUShares < minCPUShares {
+		return request, fmt.Errorf("invalid cpu_shares %d, the minimum is %d", *request.CPUShares, minCPUShares)
+	}
+	if request.CPUQuota != nil && *request.CPUQuota != -1 && *request.CPUQuota < minCPUPeriod {
+		return request, fmt.Errorf("invalid cpu_quota %d, it must be -1 or at least %d", *request.CPUQuota, minCPUPeriod)
+	}
+	if request.CPUPeriod != nil && (*request.CPUPeriod < minCPUPeriod || *request.CPUPeriod > maxCPUPeriod) {
+		return request, fmt.Errorf("invalid cpu_period %d, it must be between %d and %d", *request.CPUPeriod, minCPUPeriod, maxCPUPeriod)
+	}
+	if request.RestartPolicy != nil {
+		switch container.RestartPolicyMode(request.RestartPolicy.Name) {
+		case container.RestartPolicyOnFailure:
+			if request.RestartPolicy.MaximumRetryCount < 0 || request.RestartPolicy.MaximumRetryCount > maxRetryCount {
+				return request, fmt.Errorf("invalid max_retries %d, it must be between 0 and %d", request.RestartPolicy.MaximumRetryCount, maxRetryCount)
+			}
+		case container.RestartPolicyDisabled, container.RestartPolicyAlways, container.RestartPolicyUnlessStopped:
+			if request.RestartPolicy.MaximumRetryCount != 0 {
+				return request, fmt.Errorf("max_retries is only allowed with the on-failure restart policy")
+			}
+		default:
+			return request, fmt.Errorf("unknown restart policy %q", request.RestartPolicy.Name)
+		}
+	}
+	return request, nil
+}
+
+// checkPolicy checks the request against the resources policy of the container, given its current CPU quota and period
+func (request resourcesRequest) checkPolicy(labels map[string]string, currentCPUQuota int64, currentCPUPeriod int64) error {
+	if labels[updateResourcesLabel] != "true" {
+		return fmt.Errorf("resources updates are not allowed on this container (label %s=true is missing)", updateResourcesLabel)
+	}
+	if value, ok := labels[maxMemoryLabel]; ok {
+		maxMemory, err := parseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s label: %v", maxMemoryLabel, err)
+		}
+		if request.Memory != nil && int64(*request.Memory) > maxMemory {
+			return fmt.Errorf("memory %d exceeds the maximum of %d bytes", *request.Memory, maxMemory)
+		}
+	}
+	if value, ok := labels[maxCPUsLabel]; ok {
+		maxCPUs, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s label: %v", maxCPUsLabel, err)
+		}
+		if request.CPUs != nil && *request.CPUs > maxCPUs {
+			return fmt.Errorf("cpus %g exceeds the maximum of %g", *request.CPUs, maxCPUs)
+		}
+		// The CPUs are quota/period, so lowering only the period raises them too
+		if request.CPUQuota != nil || request.CPUPeriod != nil {
+			quota, period := currentCPUQuota, currentCPUPeriod
+			if request.CPUQuota != nil {
+				quota = *request.CPUQuota
+			}
+			if request.CPUPeriod != nil {
+				period = *request.CPUPeriod
+			}
+			if period == 0 {
+				period = defaultCPUPeriod
+			}
+			if quota == -1 || float64(quota)/float64(period) > maxCPUs {
+				return fmt.Errorf("cpu_quota %d with cpu_period %d exceeds the maximum of %g CPUs", quota, period, maxCPUs)
+			}
+		}
+	}
+	if value, ok := labels[maxCPUSharesLabel]; ok {
+		maxShares, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s label: %v", maxCPUSharesLabel, err)
+		}
+		if request.CPUShares != nil && *request.CPUShares > maxShares {
+			return fmt.Errorf("cpu_shares %d exceeds the maximum of %d", *request.CPUShares, maxShares)
+		}
+	}
+	if value, ok := labels[restartPoliciesLabel]; ok && request.RestartPolicy != nil {
+		allowed := false
+		for _, name := range strings.Split(value, ",") {
+			if strings.TrimSpace(name) == request.RestartPolicy.Name {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("restart policy %q is not allowed by the %s label", request.RestartPolicy.Name, restartPoliciesLabel)
+		}
+	}
+	return nil
+}
+
+func (request resourcesRequest) updateConfig() container.UpdateConfig {
+	var config container.UpdateConfig
+	if request.Memory != nil {
+		config.Memory = int64(*request.Memory)
+	}
+	if request.MemorySwap != nil {
+		config.MemorySwap = int64(*request.MemorySwap)
+	}
+	if request.CPUs != nil {
+		config.NanoCPUs = int64(*request.CPUs * 1e9)
+	}
+	if request.CPUShares != nil {
+		config.CPUShares = *request.CPUShares
+	}
+	if request.CPUQuota != nil {
+		config.CPUQuota = *request.CPUQuota
+	}
+	if request.CPUPeriod != nil {
+		config.CPUPeriod = *request.CPUPeriod
+	}
+	if request.RestartPolicy != nil {
+		config.RestartPolicy = container.RestartPolicy{Name: container.RestartPolicyMode(request.RestartPolicy.Name), MaximumRetryCount: request.RestartPolicy.MaximumRetryCount}
+	}
+	return config
+}
+
+// updateResources updates the resource limits of every selected container allowed by its policy, and returns the updated ones,
+// also when the update of a later container fails
+func updateResources(dockerContext context.Context, dockerClient *client.Client, request resourcesRequest) ([]string, error) {
+	ids, err := request.resolve(dockerContext, dockerClient)
+	if err != nil {
+		return nil, err
+	}
+	// Check the policy of every container first, so that none is updated if one of them is not allowed
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		info, err := dockerClient.ContainerInspect(dockerContext, id)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = strings.TrimPrefix(info.Name, "/")
+		var labels map[string]string
+		if info.Config != nil {
+			labels = info.Config.Labels
+		}
+		var quota, period int64
+		if info.HostConfig != nil {
+			quota, period = info.HostConfig.CPUQuota, info.HostConfig.CPUPeriod
+		}
+		if err := request.checkPolicy(labels, quota, period); err != nil {
+			return nil, fmt.Errorf("%s: %v", names[i], err)
+		}
+	}
+	for i, id := range ids {
+		result, err := dockerClient.ContainerUpdate(dockerContext, id, request.updateConfig())
+		if err != nil {
+			return ids[:i], fmt.Errorf("%s: %v", names[i], err)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(os.Stderr, "Warning while updating container %s: %s\n", names[i], warning)
+		}
+	}
+	return ids, nil
+}
+
+func updateResourcesHandler(client mqtt.Client, msg mqtt.Message, dockerClient *client.Client, dockerContext context.Context, topic string) ([]string, error) {
+	fmt.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
+	request, err := parseResourcesRequest(msg.Payload())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid update-resources command %s: %v\n", msg.Payload(), err)
+		return nil, err
+	}
+	ids, err := updateResources(dockerContext, dockerClient, request)
+	// The containers updated before a failure have changed too
+	for _, id := range ids {
+		publishState(client, topic, dockerContext, dockerClient, id)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to update the resources of container %s: %v\n", msg.Payload(), err)
+		return ids, err
+	}
+	fmt.Fprintf(os.Stdout, "Container %s: update-resources done\n", strings.Join(ids, ", "))
+	return ids, nil
+}
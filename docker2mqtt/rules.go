@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+// rulesConfig is the content of the rules file, like:
+//
+//	{
+//	  "notifiers": {
+//	    "phone": {"type": "ntfy", "url": "https://ntfy.sh/my-topic", "priority": "high"},
+//	    "chat": {"type": "webhook", "url": "https://chat.example.com/hook", "template": "{\"text\": {{json .Message}}}"}
+//	  },
+//	  "rules": [
+//	    {"name": "critical-died", "type": "container", "actions": ["die"], "labels": "critical", "exit_code": "!=0",
+//	     "notify": ["phone", "chat"], "dedup": "10m", "quiet_hours": {"start": "22:00", "end": "07:00"}}
+//	  ]
+//	}
+type rulesConfig struct {
+	Notifiers map[string]*notifierConfig `json:"notifiers"`
+	Rules     []*rule                    `json:"rules"`
+}
+
+// notifierConfig describes where to send the notifications: ntfy, gotify or a generic webhook
+type notifierConfig struct {
+	Type     string            `json:"type"`
+	URL      string            `json:"url"`
+	Token    string            `json:"token,omitempty"`
+	Priority string            `json:"priority,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Template string            `json:"template,omitempty"`
+	template *template.Template
+}
+
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// rule matches docker events, all the conditions given must match
+type rule struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type,omitempty"`
+	Actions    []string    `json:"actions,omitempty"`
+	Labels     string      `json:"labels,omitempty"`
+	ExitCode   string      `json:"exit_code,omitempty"`
+	Title      string      `json:"title,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Notify     []string    `json:"notify"`
+	Dedup      string      `json:"dedup,omitempty"`
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+	title      *template.Template
+	message    *template.Template
+	dedup      time.Duration
+}
+
+// notification is given to the templates
+type notification struct {
+	Rule       string            `json:"rule"`
+	Time       time.Time         `json:"time"`
+	Type       string            `json:"type"`
+	Action     string            `json:"action"`
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Image      string            `json:"image"`
+	ExitCode   string            `json:"exit_code,omitempty"`
+	Attributes map[string]string `json:"attributes"`
+	Title      string            `json:"title"`
+	Message    string            `json:"message"`
+}
+
+type rulesEngine struct {
+	config     rulesConfig
+	httpClient *http.Client
+	mutex      sync.Mutex
+	lastSent   map[string]time.Time
+	maxDedup   time.Duration // the longest dedup window of the rules, older entries of lastSent are pruned
+	lastPrune  time.Time
+}
+
+// The attributes docker adds to the container events, next to the labels of the container
+var eventAttributes = map[string]bool{"name": true, "image": true, "exitCode": true, "signal": true, "execID": true, "oldName": true}
+
+// eventLabels returns the labels of the container found in the attributes of an event.
+// Docker mixes both, so a label named like one of the attributes it adds cannot be matched.
+func eventLabels(attributes map[string]string) map[string]string {
+	labels := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		if !eventAttributes[key] {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+const defaultTitle = "{{.Name}}: {{.Action}}"
+const defaultMessage = "Container {{.Name}} ({{.Image}}): {{.Action}}{{if .ExitCode}} with exit code {{.ExitCode}}{{end}}"
+
+// loadRules reads and validates the rules file
+func loadRules(file string) (*rulesEngine, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	engine := &rulesEngine{httpClient: &http.Client{Timeout: 10 * time.Second}, lastSent: make(map[string]time.Time)}
+	if err := json.Unmarshal(data, &engine.config); err != nil {
+		return nil, fmt.Errorf("invalid rules file: %v", err)
+	}
+
+	for name, notifier := range engine.config.Notifiers {
+		switch notifier.Type {
+		case "ntfy", "gotify":
+		case "webhook":
+			if notifier.Template != "" {
+				if notifier.template, err = template.New(name).Funcs(templateFuncs).Parse(notifier.Template); err != nil {
+					return nil, fmt.Errorf("invalid template for notifier %s: %v", name, err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown type %q for notifier %s", notifier.Type, name)
+		}
+		if notifier.URL == "" {
+			return nil, fmt.Errorf("no URL for notifier %s", name)
+		}
+	}
+	for i, rule := range engine.config.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		for _, name := range rule.Notify {
+			if _, ok := engine.config.Notifiers[name]; !ok {
+				return nil, fmt.Errorf("unknown notifier %s in rule %s", name, rule.Name)
+			}
+		}
+		if rule.ExitCode != "" {
+			if _, err := matchExitCode(rule.ExitCode, "0"); err != nil {
+				return nil, fmt.Errorf("invalid exit code condition in rule %s: %v", rule.Name, err)
+			}
+		}
+		if rule.Dedup != "" {
+			if rule.dedup, err = time.ParseDuration(rule.Dedup); err != nil {
+				return nil, fmt.Errorf("invalid dedup duration in rule %s: %v", rule.Name, err)
+			}
+			engine.maxDedup = max(engine.maxDedup, rule.dedup)
+		}
+		if rule.QuietHours != nil {
+			if _, err := rule.QuietHours.contains(time.Now()); err != nil {
+				return nil, fmt.Errorf("invalid quiet hours in rule %s: %v", rule.Name, err)
+			}
+		}
+		if rule.Title == "" {
+			rule.Title = defaultTitle
+		}
+		if rule.Message == "" {
+			rule.Message = defaultMessage
+		}
+		if rule.title, err = template.New("title").Funcs(templateFuncs).Parse(rule.Title); err != nil {
+			return nil, fmt.Errorf("invalid title in rule %s: %v", rule.Name, err)
+		}
+		if rule.message, err = template.New("message").Funcs(templateFuncs).Parse(rule.Message); err != nil {
+			return nil, fmt.Errorf("invalid message in rule %s: %v", rule.Name, err)
+		}
+	}
+	return engine, nil
+}
+
+// matchExitCode checks an exit code against a condition like 137, ==0, !=0 or >128
+func matchExitCode(condition string, exitCode string) (bool, error) {
+	operator := "=="
+	for _, op := range []string{"==", "!=", ">=", "<=", ">", "<"} {
+		if strings.HasPrefix(condition, op) {
+			operator = op
+			condition = condition[len(op):]
+			break
+		}
+	}
+	expected, err := strconv.Atoi(strings.TrimSpace(condition))
+	if err != nil {
+		return false, err
+	}
+	actual, err := strconv.Atoi(exitCode)
+	if err != nil {
+		return false, nil
+	}
+	switch operator {
+	case "!=":
+		return actual != expected, nil
+	case ">=":
+		return actual >= expected, nil
+	case "<=":
+		return actual <= expected, nil
+	case ">":
+		return actual > expected, nil
+	case "<":
+		return actual < expected, nil
+	default:
+		return actual == expected, nil
+	}
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+// contains tells if the time is within the quiet hours, which can span midnight
+func (quiet *quietHours) contains(now time.Time) (bool, error) {
+	start, err := parseClock(quiet.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := parseClock(quiet.End)
+	if err != nil {
+		return false, err
+	}
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if start <= end {
+		return clock >= start && clock < end, nil
+	}
+	return clock >= start || clock < end, nil
+}
+
+func (rule *rule) matches(msg events.Message) bool {
+	if rule.Type != "" && rule.Type != string(msg.Type) {
+		return false
+	}
+	if len(rule.Actions) > 0 {
+		found := false
+		for _, action := range rule.Actions {
+			// Actions like "health_status: unhealthy" can be matched by their prefix ("health_status") or completely
+			if action == string(msg.Action) || strings.HasPrefix(string(msg.Action), action+":") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if rule.Labels != "" && !matchLabels(eventLabels(msg.Actor.Attributes), rule.Labels) {
+		return false
+	}
+	if rule.ExitCode != "" {
+		exitCode, ok := msg.Actor.Attributes["exitCode"]
+		if !ok {
+			return false
+		}
+		if match, _ := matchExitCode(rule.ExitCode, exitCode); !match {
+			return false
+		}
+	}
+	return true
+}
+
+// handleEvent sends the notifications of every rule matching the event
+func (engine *rulesEngine) handleEvent(msg events.Message) {
+	for _, rule := range engine.config.Rules {
+		if !rule.matches(msg) {
+			continue
+		}
+		name := msg.Actor.Attributes["name"]
+		if rule.QuietHours != nil {
+			if quiet, _ := rule.QuietHours.contains(time.Now()); quiet {
+				fmt.Printf("Rule %s matched for %s during quiet hours, no notification sent\n", rule.Name, name)
+				continue
+			}
+		}
+		if engine.duplicate(rule, name+"/"+string(msg.Action), time.Now()) {
+			fmt.Printf("Rule %s matched for %s, duplicate notification not sent\n", rule.Name, name)
+			continue
+		}
+
+		n := notification{
+			Rule:       rule.Name,
+			Time:       time.Unix(0, msg.TimeNano),
+			Type:       string(msg.Type),
+			Action:     string(msg.Action),
+			ID:         msg.Actor.ID,
+			Name:       name,
+			Image:      msg.Actor.Attributes["image"],
+			ExitCode:   msg.Actor.Attributes["exitCode"],
+			Attributes: msg.Actor.Attributes,
+		}
+		var title, message strings.Builder
+		if err := rule.title.Execute(&title, n); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to render the title of rule %s: %v\n", rule.Name, err)
+			continue
+		}
+		if err := rule.message.Execute(&message, n); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to render the message of rule %s: %v\n", rule.Name, err)
+			continue
+		}
+		n.Title, n.Message = title.String(), message.String()
+
+		for _, notifierName := range rule.Notify {
+			go func(notifierName string, notifier *notifierConfig) {
+				if err := engine.send(notifier, n); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to send the notification of rule %s to %s: %v\n", rule.Name, notifierName, err)
+				} else {
+					fmt.Printf("Notification of rule %s sent to %s\n", rule.Name, notifierName)
+				}
+			}(notifierName, engine.config.Notifiers[notifierName])
+		}
+	}
+}
+
+// duplicate tells if the rule already notified the same event within its dedup window, and records it otherwise
+func (engine *rulesEngine) duplicate(rule *rule, event string, now time.Time) bool {
+	if rule.dedup <= 0 {
+		return false
+	}
+	key := rule.Name + "/" + event
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	if now.Sub(engine.lastPrune) >= engine.maxDedup {
+		for key, last := range engine.lastSent {
+			if now.Sub(last) >= engine.maxDedup {
+				delete(engine.lastSent, key)
+			}
+		}
+		engine.lastPrune = now
+	}
+	if last, sent := engine.lastSent[key]; sent && now.Sub(last) < rule.dedup {
+		return true
+	}
+	engine.lastSent[key] = now
+	return false
+}
+
+func (engine *rulesEngine) send(notifier *notifierConfig, n notification) error {
+	var req *http.Request
+	var err error
+	switch notifier.Type {
+	case "ntfy":
+		req, err = http.NewRequest(http.MethodPost, notifier.URL, strings.NewReader(n.Message))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Title", n.Title)
+		req.Header.Set("Tags", "whale")
+		if notifier.Priority != "" {
+			req.Header.Set("Priority", notifier.Priority)
+		}
+		if notifier.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+notifier.Token)
+		}
+	case "gotify":
+		priority := 5
+		if notifier.Priority != "" {
+			if priority, err = strconv.Atoi(notifier.Priority); err != nil {
+				return fmt.Errorf("invalid gotify priority %q", notifier.Priority)
+			}
+		}
+		body, err := json.Marshal(map[string]any{"title": n.Title, "message": n.Message, "priority": priority})
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(notifier.URL, "/")+"/message", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", notifier.Token)
+	case "webhook":
+		var body bytes.Buffer
+		if notifier.template != nil {
+			if err := notifier.template.Execute(&body, n); err != nil {
+				return err
+			}
+		} else if err := json.NewEncoder(&body).Encode(n); err != nil {
+			return err
+		}
+		method := http.MethodPost
+		if notifier.Method != "" {
+			method = notifier.Method
+		}
+		req, err = http.NewRequest(method, notifier.URL, &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if notifier.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+notifier.Token)
+		}
+	}
+	for key, value := range notifier.Headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := engine.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestMatchExitCode(t *testing.T) {
+	tests := []struct {
+		condition, exitCode string
+		match               bool
+		err                 bool
+	}{
+		{"137", "137", true, false},
+		{"137", "1", false, false},
+		{"==0", "0", true, false},
+		{"!=0", "0", false, false},
+		{"!=0", "143", true, false},
+		{">128", "137", true, false},
+		{">128", "128", false, false},
+		{">=128", "128", true, false},
+		{"<2", "1", true, false},
+		{"<=1", "2", false, false},
+		{"!= 0", "1", true, false},
+		{"!=0", "", false, false},
+		{"abc", "0", false, true},
+		{">", "0", false, true},
+	}
+	for _, test := range tests {
+		match, err := matchExitCode(test.condition, test.exitCode)
+		if (err != nil) != test.err {
+			t.Errorf("matchExitCode(%q, %q) error = %v, want error %v", test.condition, test.exitCode, err, test.err)
+		}
+		if match != test.match {
+			t.Errorf("matchExitCode(%q, %q) = %v, want %v", test.condition, test.exitCode, match, test.match)
+		}
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	tests := []struct {
+		start, end, now string
+		quiet           bool
+	}{
+		{"22:00", "07:00", "23:30", true},
+		{"22:00", "07:00", "00:00", true},
+		{"22:00", "07:00", "06:59", true},
+		{"22:00", "07:00", "07:00", false},
+		{"22:00", "07:00", "21:59", false},
+		{"12:00", "14:00", "12:00", true},
+		{"12:00", "14:00", "13:59", true},
+		{"12:00", "14:00", "14:00", false},
+		{"12:00", "14:00", "11:00", false},
+		{"08:00", "08:00", "08:00", false},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse("15:04", test.now)
+		quiet, err := (&quietHours{Start: test.start, End: test.end}).contains(now)
+		if err != nil {
+			t.Fatalf("contains(%s) for %s-%s: %v", test.now, test.start, test.end, err)
+		}
+		if quiet != test.quiet {
+			t.Errorf("contains(%s) for %s-%s = %v, want %v", test.now, test.start, test.end, quiet, test.quiet)
+		}
+	}
+
+	if _, err := (&quietHours{Start: "25:00", End: "07:00"}).contains(time.Now()); err == nil {
+		t.Error("contains with an invalid start: no error")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	engine := &rulesEngine{lastSent: make(map[string]time.Time), maxDedup: 10 * time.Minute}
+	short := &rule{Name: "short", dedup: time.Minute}
+	long := &rule{Name: "long", dedup: 10 * time.Minute}
+	none := &rule{Name: "none"}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rule      *rule
+		event     string
+		elapsed   time.Duration
+		duplicate bool
+	}{
+		{short, "web/die", 0, false},
+		{short, "web/die", 30 * time.Second, true},
+		{short, "db/die", 30 * time.Second, false},
+		{short, "web/start", 30 * time.Second, false},
+		{long, "web/die", 30 * time.Second, false},
+		{short, "web/die", 61 * time.Second, false},
+		{long, "web/die", 5 * time.Minute, true},
+		{none, "web/die", 5 * time.Minute, false},
+		{none, "web/die", 5 * time.Minute, false},
+	}
+	for i, test := range tests {
+		if duplicate := engine.duplicate(test.rule, test.event, start.Add(test.elapsed)); duplicate != test.duplicate {
+			t.Errorf("#%d duplicate(%s, %s) = %v, want %v", i, test.rule.Name, test.event, duplicate, test.duplicate)
+		}
+	}
+
+	// The entries older than the longest dedup window are pruned
+	engine.duplicate(short, "web/die", start.Add(time.Hour))
+	if len(engine.lastSent) != 1 {
+		t.Errorf("after pruning, %d entries are kept, want 1: %v", len(engine.lastSent), engine.lastSent)
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	msg := events.Message{
+		Type:   events.ContainerEventType,
+		Action: events.ActionDie,
+		Actor: events.Actor{ID: "abc", Attributes: map[string]string{
+			"name": "web", "image": "nginx", "exitCode": "137", "critical": "true",
+		}},
+	}
+	tests := []struct {
+		rule  rule
+		match bool
+	}{
+		{rule{}, true},
+		{rule{Type: "container", Actions: []string{"die"}}, true},
+		{rule{Actions: []string{"start", "stop"}}, false},
+		{rule{Labels: "critical"}, true},
+		{rule{Labels: "critical=false"}, false},
+		{rule{Labels: "name=web"}, false},
+		{rule{Labels: "image"}, false},
+		{rule{ExitCode: "!=0"}, true},
+		{rule{ExitCode: "0"}, false},
+	}
+	for _, test := range tests {
+		if match := test.rule.matches(msg); match != test.match {
+			t.Errorf("%+v matches = %v, want %v", test.rule, match, test.match)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	type received struct {
+		method, path string
+		header       http.Header
+		body         string
+	}
+	requests := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{r.Method, r.URL.Path, r.Header, string(body)}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	engine := &rulesEngine{httpClient: server.Client()}
+	n := notification{Rule: "critical-died", Name: "web", Action: "die", Title: "web: die", Message: "Container web died"}
+
+	t.Run("ntfy", func(t *testing.T) {
+		if err := engine.send(&notifierConfig{Type: "ntfy", URL: server.URL + "/topic", Priority: "high", Token: "secret"}, n); err != nil {
+			t.Fatal(err)
+		}
+		r := <-requests
+		if r.path != "/topic" || r.body != n.Message || r.header.Get("Title") != n.Title || r.header.Get("Priority") != "high" || r.header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected request: %+v", r)
+		}
+	})
+
+	t.Run("gotify", func(t *testing.T) {
+		if err := engine.send(&notifierConfig{Type: "gotify", URL: server.URL + "/", Token: "key", Priority: "8"}, n); err != nil {
+			t.Fatal(err)
+		}
+		r := <-requests
+		var body struct {
+			Title    string `json:"title"`
+			Message  string `json:"message"`
+			Priority int    `json:"priority"`
+		}
+		if err := json.Unmarshal([]byte(r.body), &body); err != nil {
+			t.Fatal(err)
+		}
+		if r.path != "/message" || r.header.Get("X-Gotify-Key") != "key" || body.Title != n.Title || body.Message != n.Message || body.Priority != 8 {
+			t.Errorf("unexpected request: %+v", r)
+		}
+	})
+
+	t.Run("webhook template", func(t *testing.T) {
+		notifier := &notifierConfig{Type: "webhook", URL: server.URL + "/hook", Method: http.MethodPut, Headers: map[string]string{"X-Source": "docker2mqtt"}}
+		notifier.template = template.Must(template.New("hook").Funcs(templateFuncs).Parse(`{"text": {{json .Message}}}`))
+		if err := engine.send(notifier, n); err != nil {
+			t.Fatal(err)
+		}
+		r := <-requests
+		if r.method != http.MethodPut || r.header.Get("X-Source") != "docker2mqtt" || r.body != `{"text": "Container web died"}` {
+			t.Errorf("unexpected request: %+v", r)
+		}
+	})
+
+	t.Run("webhook error", func(t *testing.T) {
+		if err := engine.send(&notifierConfig{Type: "webhook", URL: server.URL + "/fail"}, n); err == nil {
+			t.Error("no error for a status code 500")
+		}
+		<-requests
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+type containerResources struct {
+	Memory            int64  `json:"memory"`
+	MemorySwap        int64  `json:"memory_swap"`
+	CPUShares         int64  `json:"cpu_shares"`
+	CPUQuota          int64  `json:"cpu_quota"`
+	CPUPeriod         int64  `json:"cpu_period"`
+	NanoCPUs          int64  `json:"nano_cpus"`
+	RestartPolicy     string `json:"restart_policy"`
+	RestartMaxRetries int    `json:"restart_max_retries"`
+}
+
+type containerState struct {
+	ID        string              `json:"id"`
+	Name      string              `json:"name"`
+	Image     string              `json:"image"`
+	State     string              `json:"state"`
+	Status    string              `json:"status,omitempty"`
+	Created   int64               `json:"created"`
+	Labels    map[string]string   `json:"labels"`
+	Resources *containerResources `json:"resources,omitempty"`
+}
+
+// inspectState returns the state of the container, along with its resource limits
+func inspectState(dockerContext context.Context, dockerClient *client.Client, id string) (containerState, error) {
+	info, err := dockerClient.ContainerInspect(dockerContext, id)
+	if err != nil {
+		return containerState{}, err
+	}
+	state := containerState{ID: info.ID, Name: strings.TrimPrefix(info.Name, "/")}
+	if created, err := time.Parse(time.RFC3339Nano, info.Created); err == nil {
+		state.Created = created.Unix()
+	}
+	if info.State != nil {
+		state.State = info.State.Status
+	}
+	if info.Config != nil {
+		state.Image = info.Config.Image
+		state.Labels = info.Config.Labels
+	}
+	if info.HostConfig != nil {
+		state.Resources = &containerResources{
+			Memory:            info.HostConfig.Memory,
+			MemorySwap:        info.HostConfig.MemorySwap,
+			CPUShares:         info.HostConfig.CPUShares,
+			CPUQuota:          info.HostConfig.CPUQuota,
+			CPUPeriod:         info.HostConfig.CPUPeriod,
+			NanoCPUs:          info.HostConfig.NanoCPUs,
+			RestartPolicy:     string(info.HostConfig.RestartPolicy.Name),
+			RestartMaxRetries: info.HostConfig.RestartPolicy.MaximumRetryCount,
+		}
+	}
+	return state, nil
+}
+
+// publishState publishes the state of the container, retained, on <topic>/containers/<name>
+func publishState(client mqtt.Client, topic string, dockerContext context.Context, dockerClient *client.Client, id string) {
+	state, err := inspectState(dockerContext, dockerClient, id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to inspect container %s: %v\n", id, err)
+		return
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode the state of container %s: %v\n", id, err)
+		return
+	}
+	client.Publish(topic+"/containers/"+state.Name, 1, true, payload)
+}
+
+// handleStateEvent keeps the state topics up to date after the docker events changing the containers
+func handleStateEvent(client mqtt.Client, topic string, dockerContext context.Context, dockerClient *client.Client, msg events.Message) {
+	if msg.Type != events.ContainerEventType {
+		return
+	}
+	switch msg.Action {
+	case events.ActionDestroy:
+		client.Publish(topic+"/containers/"+msg.Actor.Attributes["name"], 1, true, "")
+	case events.ActionRename:
+		client.Publish(topic+"/containers/"+strings.TrimPrefix(msg.Actor.Attributes["oldName"], "/"), 1, true, "")
+		publishState(client, topic, dockerContext, dockerClient, msg.Actor.ID)
+	case events.ActionCreate, events.ActionStart, events.ActionDie, events.ActionStop, events.ActionPause, events.ActionUnPause, events.ActionUpdate:
+		publishState(client, topic, dockerContext, dockerClient, msg.Actor.ID)
+	}
+}
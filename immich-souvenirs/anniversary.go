@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Règles des anniversaires d'albums
+type AnniversaryRules struct {
+	Years      []int  // Années à annoncer, toutes si vide
+	EveryYears int    // Annoncer aussi les multiples de ce nombre d'années, 0 si aucun
+	Feb29      string // Anniversaire des albums du 29 février les années non bissextiles : feb28, mar1 ou skip
+	AssetDates bool   // Dater les albums par leur photo la plus ancienne plutôt que par leur date de début
+}
+
+// Fonction pour lire les règles des anniversaires :
+//   - ANNIVERSARY-YEARS, les années à annoncer, comme "1,5,10" ; "*5" annonce tous les 5 ans (toutes les années par défaut)
+//   - ANNIVERSARY-FEB29, l'anniversaire des albums du 29 février les années non bissextiles : feb28 (par défaut), mar1 ou skip
+//   - ANNIVERSARY-DATE, la date des albums : start (date de début, par défaut) ou asset (photo la plus ancienne)
+func loadAnniversaryRules(param *Parameters) (*AnniversaryRules, error) {
+	rules := &AnniversaryRules{Feb29: "feb28"}
+	for _, item := range splitList(param.AnniversaryYears) {
+		every := strings.HasPrefix(item, "*")
+		years, err := strconv.Atoi(strings.TrimPrefix(item, "*"))
+		if err != nil || years < 1 {
+			return nil, fmt.Errorf("invalid ANNIVERSARY-YEARS '%s'", param.AnniversaryYears)
+		}
+		if every {
+			rules.EveryYears = years
+		} else {
+			rules.Years = append(rules.Years, years)
+		}
+	}
+	switch param.AnniversaryFeb29 {
+	case "":
+	case "feb28", "mar1", "skip":
+		rules.Feb29 = param.AnniversaryFeb29
+	default:
+		return nil, fmt.Errorf("invalid ANNIVERSARY-FEB29 '%s', it must be feb28, mar1 or skip", param.AnniversaryFeb29)
+	}
+	switch param.AnniversaryDate {
+	case "", "start":
+	case "asset":
+		rules.AssetDates = true
+	default:
+		return nil, fmt.Errorf("invalid ANNIVERSARY-DATE '%s', it must be start or asset", param.AnniversaryDate)
+	}
+	return rules, nil
+}
+
+// Méthode pour vérifier si day est un anniversaire à annoncer de la date start.
+// L'année même de start n'est jamais un anniversaire.
+func (rules *AnniversaryRules) Matches(start time.Time, day time.Time) bool {
+	years := day.Year() - start.Year()
+	if years <= 0 || !rules.milestone(years) {
+		return false
+	}
+	if start.Month() == day.Month() && start.Day() == day.Day() {
+		return true
+	}
+
+	// Les albums du 29 février les années non bissextiles
+	if start.Month() != time.February || start.Day() != 29 || isLeapYear(day.Year()) {
+		return false
+	}
+	switch rules.Feb29 {
+	case "feb28":
+		return day.Month() == time.February && day.Day() == 28
+	case "mar1":
+		return day.Month() == time.March && day.Day() == 1
+	}
+	return false
+}
+
+func (rules *AnniversaryRules) milestone(years int) bool {
+	if len(rules.Years) == 0 && rules.EveryYears == 0 {
+		return true
+	}
+	if rules.EveryYears > 0 && years%rules.EveryYears == 0 {
+		return true
+	}
+	for _, milestone := range rules.Years {
+		if years == milestone {
+			return true
+		}
+	}
+	return false
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// Fonction pour dater les albums par leur photo la plus ancienne si ANNIVERSARY-DATE vaut asset, obtenue par une recherche d'une seule photo.
+// Les albums dont les photos ne peuvent pas être récupérées gardent leur date de début.
+func applyAssetDates(immichClient *ImmichClient, rules *AnniversaryRules, albums []Album, selects func(Album) bool) {
+	if !rules.AssetDates {
+		return
+	}
+	for i, album := range albums {
+		if !selects(album) {
+			continue
+		}
+		earliest, found, err := immichClient.FetchEarliestAlbumAsset(album.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "erreur récupération photos de l'album '%s': %v\n", album.Name, err)
+			continue
+		}
+		if found && !earliest.Date().IsZero() {
+			albums[i].StartDate = earliest.Date()
+		}
+	}
+}
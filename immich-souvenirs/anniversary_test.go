@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func parseDay(value string) time.Time {
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		panic(err)
+	}
+	return day
+}
+
+func TestMilestone(t *testing.T) {
+	tests := []struct {
+		rules AnniversaryRules
+		years int
+		want  bool
+	}{
+		{AnniversaryRules{}, 1, true},
+		{AnniversaryRules{}, 7, true},
+		{AnniversaryRules{Years: []int{1, 5, 10}}, 5, true},
+		{AnniversaryRules{Years: []int{1, 5, 10}}, 3, false},
+		{AnniversaryRules{EveryYears: 5}, 5, true},
+		{AnniversaryRules{EveryYears: 5}, 15, true},
+		{AnniversaryRules{EveryYears: 5}, 12, false},
+		{AnniversaryRules{Years: []int{1}, EveryYears: 5}, 1, true},
+		{AnniversaryRules{Years: []int{1}, EveryYears: 5}, 10, true},
+		{AnniversaryRules{Years: []int{1}, EveryYears: 5}, 2, false},
+	}
+	for _, test := range tests {
+		if got := test.rules.milestone(test.years); got != test.want {
+			t.Errorf("%+v milestone(%d) = %v, want %v", test.rules, test.years, got, test.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		rules      AnniversaryRules
+		start, day string
+		want       bool
+	}{
+		// Anniversaire ordinaire
+		{AnniversaryRules{Feb29: "feb28"}, "2020-06-15", "2024-06-15", true},
+		{AnniversaryRules{Feb29: "feb28"}, "2020-06-15", "2024-06-16", false},
+		{AnniversaryRules{Feb29: "feb28"}, "2024-06-15", "2024-06-15", false},
+		{AnniversaryRules{Feb29: "feb28"}, "2025-06-15", "2024-06-15", false},
+		// Années annoncées
+		{AnniversaryRules{Feb29: "feb28", EveryYears: 5}, "2014-06-15", "2024-06-15", true},
+		{AnniversaryRules{Feb29: "feb28", EveryYears: 5}, "2016-06-15", "2024-06-15", false},
+		{AnniversaryRules{Feb29: "feb28", Years: []int{1, 8}}, "2016-06-15", "2024-06-15", true},
+		// 29 février les années bissextiles
+		{AnniversaryRules{Feb29: "feb28"}, "2020-02-29", "2024-02-29", true},
+		{AnniversaryRules{Feb29: "feb28"}, "2020-02-29", "2024-02-28", false},
+		{AnniversaryRules{Feb29: "mar1"}, "2020-02-29", "2024-03-01", false},
+		{AnniversaryRules{Feb29: "skip"}, "2020-02-29", "2024-02-29", true},
+		// 29 février les années non bissextiles
+		{AnniversaryRules{Feb29: "feb28"}, "2020-02-29", "2023-02-28", true},
+		{AnniversaryRules{Feb29: "feb28"}, "2020-02-29", "2023-03-01", false},
+		{AnniversaryRules{Feb29: "mar1"}, "2020-02-29", "2023-03-01", true},
+		{AnniversaryRules{Feb29: "mar1"}, "2020-02-29", "2023-02-28", false},
+		{AnniversaryRules{Feb29: "skip"}, "2020-02-29", "2023-02-28", false},
+		{AnniversaryRules{Feb29: "skip"}, "2020-02-29", "2023-03-01", false},
+		// 1900 et 2100 ne sont pas bissextiles, 2000 l'est
+		{AnniversaryRules{Feb29: "feb28"}, "1896-02-29", "1900-02-28", true},
+		{AnniversaryRules{Feb29: "feb28"}, "1996-02-29", "2000-02-28", false},
+		{AnniversaryRules{Feb29: "mar1"}, "2096-02-29", "2100-03-01", true},
+		// Le 29 février avec les années annoncées
+		{AnniversaryRules{Feb29: "feb28", EveryYears: 5}, "2020-02-29", "2025-02-28", true},
+		{AnniversaryRules{Feb29: "feb28", EveryYears: 5}, "2020-02-29", "2023-02-28", false},
+	}
+	for _, test := range tests {
+		if got := test.rules.Matches(parseDay(test.start), parseDay(test.day)); got != test.want {
+			t.Errorf("%+v Matches(%s, %s) = %v, want %v", test.rules, test.start, test.day, got, test.want)
+		}
+	}
+}
+
+func TestIsLeapYear(t *testing.T) {
+	for year, want := range map[int]bool{1900: false, 2000: true, 2023: false, 2024: true, 2100: false} {
+		if got := isLeapYear(year); got != want {
+			t.Errorf("isLeapYear(%d) = %v, want %v", year, got, want)
+		}
+	}
+}
+
+func TestLoadAnniversaryRules(t *testing.T) {
+	rules, err := loadAnniversaryRules(&Parameters{AnniversaryYears: "1, 5, *10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Years) != 2 || rules.Years[0] != 1 || rules.Years[1] != 5 || rules.EveryYears != 10 || rules.Feb29 != "feb28" {
+		t.Errorf("unexpected rules: %+v", rules)
+	}
+	for _, param := range []Parameters{{AnniversaryYears: "*0"}, {AnniversaryYears: "x"}, {AnniversaryFeb29: "feb30"}, {AnniversaryDate: "end"}} {
+		if _, err := loadAnniversaryRules(&param); err == nil {
+			t.Errorf("no error for %+v", param)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"sort"
+
+	"github.com/disintegration/imaging"
+	_ "golang.org/x/image/webp"
+)
+
+// Dimensions de la mosaïque, en pixels, et taille maximale du JPEG pour rester dans les limites des miniatures WhatsApp
+const (
+	collageSize      = 600
+	collageGap       = 4
+	minCollageSize   = 200
+	maxThumbnailSize = 100 * 1024
+)
+
+// Fonction pour lire la grille de la mosaïque de COLLAGE : vide (désactivée), 2x2 ou 3x3
+func parseCollageGrid(value string) (int, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "2x2":
+		return 2, nil
+	case "3x3":
+		return 3, nil
+	default:
+		return 0, fmt.Errorf("invalid COLLAGE '%s', it must be 2x2 or 3x3", value)
+	}
+}
+
+// Fonction pour obtenir la miniature d'un album : une mosaïque de ses photos si COLLAGE est renseigné, sinon sa miniature
+func albumThumbnail(immichClient *ImmichClient, param *Parameters, album Album) ([]byte, error) {
+	if grid, _ := parseCollageGrid(param.Collage); grid > 0 {
+		assets, err := immichClient.FetchAlbumAssets(album.ID)
+		if err == nil {
+			var thumbnail []byte
+			thumbnail, err = buildCollage(immichClient, assets, grid)
+			if err == nil && thumbnail != nil {
+				return thumbnail, nil
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "erreur mosaïque de l'album '%s', utilisation de sa miniature: %v\n", album.Name, err)
+		}
+	}
+	return immichClient.GetThumbnail(album.AlbumThumbnailAssetId, SizePreview)
+}
+
+// Fonction pour obtenir la miniature d'une liste de photos : une mosaïque si COLLAGE est renseigné, sinon la photo de couverture
+func assetsThumbnail(immichClient *ImmichClient, param *Parameters, assets []Asset) ([]byte, error) {
+	if grid, _ := parseCollageGrid(param.Collage); grid > 0 {
+		thumbnail, err := buildCollage(immichClient, assets, grid)
+		if err == nil && thumbnail != nil {
+			return thumbnail, nil
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "erreur mosaïque, utilisation de la photo de couverture: %v\n", err)
+		}
+	}
+	return immichClient.GetThumbnail(coverAsset(assets).ID, SizePreview)
+}
+
+// Fonction pour construire la mosaïque, la grille est réduite s'il n'y a pas assez de photos.
+// Elle renvoie nil s'il y a moins de 4 photos ou si la mosaïque ne tient pas dans la taille maximale.
+func buildCollage(immichClient *ImmichClient, assets []Asset, grid int) ([]byte, error) {
+	for grid > 1 && len(assets) < grid*grid {
+		grid--
+	}
+	if grid < 2 {
+		return nil, nil
+	}
+
+	var images []image.Image
+	for _, asset := range selectCollageAssets(assets, grid*grid) {
+		data, err := immichClient.GetThumbnail(asset.ID, SizeThumbnail)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding asset %s: %v", asset.ID, err)
+		}
+		images = append(images, img)
+	}
+	return renderCollage(images, grid)
+}
+
+// Fonction pour choisir les photos de la mosaïque : les favorites d'abord, puis des photos réparties sur toute la durée de l'album.
+// Elles sont renvoyées par ordre chronologique.
+func selectCollageAssets(assets []Asset, count int) []Asset {
+	sorted := append([]Asset(nil), assets...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].FileCreatedAt.Before(sorted[j].FileCreatedAt) })
+
+	var favorites, others []Asset
+	for _, asset := range sorted {
+		if asset.IsFavorite {
+			favorites = append(favorites, asset)
+		} else {
+			others = append(others, asset)
+		}
+	}
+
+	selected := spread(favorites, count)
+	selected = append(selected, spread(others, count-len(selected))...)
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].FileCreatedAt.Before(selected[j].FileCreatedAt) })
+	return selected
+}
+
+// Fonction pour choisir au plus count éléments régulièrement répartis dans la liste
+func spread(assets []Asset, count int) []Asset {
+	if count <= 0 {
+		return nil
+	}
+	if len(assets) <= count {
+		return assets
+	}
+	selected := make([]Asset, count)
+	for i := range selected {
+		selected[i] = assets[i*(len(assets)-1)/max(count-1, 1)]
+	}
+	return selected
+}
+
+// Fonction pour dessiner la mosaïque et l'encoder en JPEG, en réduisant la qualité puis les dimensions jusqu'à respecter la taille maximale.
+// Elle renvoie nil si la mosaïque est encore trop grosse à la taille minimale.
+func renderCollage(images []image.Image, grid int) ([]byte, error) {
+	cell := (collageSize - collageGap*(grid-1)) / grid
+	collage := imaging.New(collageSize, collageSize, color.White)
+	for i, img := range images {
+		x, y := i%grid, i/grid
+		collage = imaging.Paste(collage, imaging.Fill(img, cell, cell, imaging.Center, imaging.Lanczos), image.Pt(x*(cell+collageGap), y*(cell+collageGap)))
+	}
+
+	var buffer bytes.Buffer
+	for size := collageSize; size >= minCollageSize; size = size * 3 / 4 {
+		resized := collage
+		if size < collageSize {
+			resized = imaging.Resize(collage, size, size, imaging.Lanczos)
+		}
+		for quality := 85; quality >= 40; quality -= 15 {
+			buffer.Reset()
+			if err := jpeg.Encode(&buffer, resized, &jpeg.Options{Quality: quality}); err != nil {
+				return nil, err
+			}
+			if buffer.Len() <= maxThumbnailSize {
+				return buffer.Bytes(), nil
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Un SessionChecker est un canal dont la session peut être vérifiée sans être connecté
+type SessionChecker interface {
+	CheckSession() error
+}
+
+// Statistiques des exécutions, exposées par /metrics
+type Metrics struct {
+	mutex       sync.Mutex
+	runs        map[string]int // Par résultat : success ou failure
+	sent        map[string]int // Par type de message
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastRunTime time.Duration
+}
+
+var runMetrics = &Metrics{runs: make(map[string]int), sent: make(map[string]int)}
+
+// Méthode pour enregistrer une exécution, une seule fois après ses éventuelles nouvelles tentatives
+func (m *Metrics) Record(summary *RunSummary, err error, start time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastRun = start
+	m.lastRunTime = time.Since(start)
+	if err != nil {
+		m.runs["failure"]++
+	} else {
+		m.runs["success"]++
+		m.lastSuccess = start
+	}
+	m.sent[KindAnniversary] += summary.Anniversaries
+	m.sent[KindNewAlbum] += summary.NewAlbums
+	m.sent[KindOnThisDay] += summary.OnThisDay
+	m.sent[KindDigest] += summary.Digests
+}
+
+// Méthode pour écrire les statistiques au format texte de Prometheus
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+	fmt.Fprintln(w, "# HELP immich_souvenirs_runs_total Scheduled and triggered runs by result, after their retries.")
+	fmt.Fprintln(w, "# TYPE immich_souvenirs_runs_total counter")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "immich_souvenirs_runs_total{result=%q} %d\n", result, m.runs[result])
+	}
+	fmt.Fprintln(w, "# HELP immich_souvenirs_messages_sent_total Messages sent by kind.")
+	fmt.Fprintln(w, "# TYPE immich_souvenirs_messages_sent_total counter")
+	for _, kind := range []string{KindAnniversary, KindNewAlbum, KindOnThisDay, KindDigest} {
+		fmt.Fprintf(w, "immich_souvenirs_messages_sent_total{kind=%q} %d\n", kind, m.sent[kind])
+	}
+	fmt.Fprintln(w, "# HELP immich_souvenirs_last_run_timestamp_seconds Start time of the last run.")
+	fmt.Fprintln(w, "# TYPE immich_souvenirs_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(w, "immich_souvenirs_last_run_timestamp_seconds %g\n", timestamp(m.lastRun))
+	fmt.Fprintln(w, "# HELP immich_souvenirs_last_success_timestamp_seconds Start time of the last successful run.")
+	fmt.Fprintln(w, "# TYPE immich_souvenirs_last_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "immich_souvenirs_last_success_timestamp_seconds %g\n", timestamp(m.lastSuccess))
+	fmt.Fprintln(w, "# HELP immich_souvenirs_last_run_duration_seconds Duration of the last run.")
+	fmt.Fprintln(w, "# TYPE immich_souvenirs_last_run_duration_seconds gauge")
+	fmt.Fprintf(w, "immich_souvenirs_last_run_duration_seconds %g\n", m.lastRunTime.Seconds())
+}
+
+// Serveur HTTP de contrôle, démarré si HTTP-LISTEN est renseigné (comme "127.0.0.1:8080" ou ":8080") :
+//   - GET /healthz, l'état des sessions WhatsApp (la connexion n'est ouverte que pendant les exécutions) et la connexion à Immich
+//   - GET /metrics, les statistiques des exécutions
+//   - POST /run?jobs=anniversaries,new-albums, une exécution immédiate
+//   - GET /preview?date=AAAA-MM-JJ&jobs=..., les messages qui seraient envoyés ce jour-là
+//
+// Sans paramètre jobs, les messages de toutes les planifications sont concernés.
+// Si HTTP-TOKEN est renseigné, /run et /preview exigent l'en-tête "Authorization: Bearer <HTTP-TOKEN>".
+type ControlServer struct {
+	router       *Router
+	immichClient *ImmichClient
+	param        *Parameters
+	jobs         Jobs
+	run          func(Jobs) bool // Lance une exécution en arrière-plan, false si une exécution est déjà en cours
+}
+
+// Fonction pour démarrer le serveur de contrôle, elle ne rend la main qu'en cas d'erreur
+func startControlServer(router *Router, immichClient *ImmichClient, param *Parameters, jobs Jobs, run func(Jobs) bool) error {
+	server := &ControlServer{router: router, immichClient: immichClient, param: param, jobs: jobs, run: run}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.healthz)
+	mux.HandleFunc("/metrics", server.metrics)
+	mux.HandleFunc("/run", server.authorized(server.trigger))
+	mux.HandleFunc("/preview", server.authorized(server.preview))
+	fmt.Printf("Control server listening on %s\n", param.HTTPListen)
+	if param.HTTPToken == "" {
+		fmt.Fprintln(os.Stderr, "warning: HTTP-TOKEN is not set, anyone reaching the control server can trigger runs and preview messages")
+	}
+	return (&http.Server{Addr: param.HTTPListen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}).ListenAndServe()
+}
+
+// Méthode pour exiger le jeton HTTP-TOKEN, s'il est renseigné, avant d'appeler handler
+func (s *ControlServer) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.param.HTTPToken != "" {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.param.HTTPToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// Méthode pour lire le paramètre jobs de la requête, les messages des planifications par défaut
+func (s *ControlServer) requestJobs(r *http.Request) (Jobs, error) {
+	if list := r.URL.Query().Get("jobs"); list != "" {
+		return parseJobs(list)
+	}
+	return s.jobs, nil
+}
+
+func (s *ControlServer) healthz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	healthy := true
+	check := func(name string, err error) {
+		checks[name] = "ok"
+		if err != nil {
+			checks[name] = err.Error()
+			healthy = false
+		}
+	}
+	for _, destination := range s.router.All() {
+		if checker, ok := destination.Notifier.(SessionChecker); ok {
+			check(destination.Name+"-session", checker.CheckSession())
+		}
+	}
+	_, err := s.immichClient.ServerVersion()
+	check("immich", err)
+
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"healthy": healthy, "checks": checks})
+}
+
+func (s *ControlServer) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	runMetrics.Write(w)
+}
+
+func (s *ControlServer) trigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobs, err := s.requestJobs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.run(jobs) {
+		http.Error(w, "a run is already in progress", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "run of %s started\n", jobs)
+}
+
+// Message affiché dans l'aperçu
+type previewMessage struct {
+	Kind         string
+	Message      Message
+	Destinations []string
+	AlreadySent  bool
+}
+
+func (m previewMessage) ThumbnailURL() template.URL {
+	if len(m.Message.Thumbnail) == 0 {
+		return ""
+	}
+	return template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(m.Message.Thumbnail))
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Immich souvenirs - {{.Date}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.message { display: flex; gap: 1em; border: 1px solid #ccc; border-radius: 8px; padding: 1em; margin: 1em 0; }
+.message img { width: 150px; height: 150px; object-fit: cover; }
+.kind, .destinations { color: #666; font-size: 0.9em; }
+.text { white-space: pre-wrap; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Date}} ({{.Jobs}})</h1>
+{{range .Errors}}<p class="error">{{.}}</p>
+{{end}}{{range .Messages}}<div class="message">
+{{with .ThumbnailURL}}<img src="{{.}}" alt="">{{end}}
+<div>
+<div class="kind">{{.Kind}}{{if .AlreadySent}} (already sent){{end}}</div>
+<h2>{{.Message.Title}}</h2>
+{{with .Message.Description}}<p>{{.}}</p>{{end}}
+<p class="text">{{.Message.Text}}</p>
+<div class="destinations">{{range $i, $d := .Destinations}}{{if $i}}, {{end}}{{$d}}{{end}}</div>
+</div>
+</div>
+{{else}}<p>No message.</p>
+{{end}}</body>
+</html>
+`))
+
+func (s *ControlServer) preview(w http.ResponseWriter, r *http.Request) {
+	date := time.Now()
+	if value := r.URL.Query().Get("date"); value != "" {
+		location, err := loadLocation(s.param)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		date, err = time.ParseInLocation(time.DateOnly, value, location)
+		if err != nil {
+			http.Error(w, "invalid date, it must look like YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	jobs, err := s.requestJobs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, warnings, err := previewMessages(s.router, s.immichClient, s.param, jobs, date)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = previewTemplate.Execute(w, map[string]interface{}{
+		"Date":     date.Format(time.DateOnly),
+		"Jobs":     jobs,
+		"Messages": messages,
+		"Errors":   warnings,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erreur aperçu: %v\n", err)
+	}
+}
+
+// Fonction pour construire les messages qui seraient envoyés le jour today, sans créer de lien partagé ni rien envoyer.
+// Les liens sont remplacés par un lien fictif, les erreurs qui n'empêchent pas l'aperçu sont renvoyées dans warnings.
+func previewMessages(router *Router, immichClient *ImmichClient, param *Parameters, jobs Jobs, today time.Time) (messages []previewMessage, warnings []string, err error) {
+	ledger, err := OpenLedger(ledgerFile(param))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ledger.Close()
+
+	router.ResetTags()
+	albums, err := immichClient.FetchAlbums()
+	if err != nil {
+		return nil, nil, err
+	}
+	if jobs.Anniversaries || jobs.Digest {
+		applyAssetDates(immichClient, param.Anniversaries, albums, param.Filter.Selects)
+	}
+	link := placeholderLink(param)
+	fail := func(err error) { warnings = append(warnings, err.Error()) }
+
+	add := func(album Album, kind string, build func() (Message, error)) {
+		destinations, err := router.Route(album, immichClient)
+		if err != nil {
+			fail(fmt.Errorf("erreur routage: %v", err))
+			return
+		}
+		// Un message sans destination n'est pas envoyé
+		if len(destinations) == 0 {
+			return
+		}
+		pending, err := ledger.Pending(album, kind, today, destinations)
+		if err != nil {
+			fail(fmt.Errorf("erreur registre: %v", err))
+			return
+		}
+		msg, err := build()
+		if err != nil {
+			fail(err)
+			return
+		}
+		preview := previewMessage{Kind: kind, Message: msg, AlreadySent: len(pending) == 0}
+		for _, destination := range destinations {
+			preview.Destinations = append(preview.Destinations, destination.Name)
+		}
+		messages = append(messages, preview)
+	}
+
+	for _, entry := range dueAlbums(albums, param, jobs, today) {
+		add(entry.Album, entry.Kind, func() (Message, error) {
+			text, err := albumText(param, entry, link)
+			if err != nil {
+				return Message{}, err
+			}
+			thumbnail, err := albumThumbnail(immichClient, param, entry.Album)
+			if err != nil {
+				return Message{}, fmt.Errorf("erreur miniature: %v", err)
+			}
+			return Message{Title: entry.Album.Name, Description: entry.Album.Description, Text: text, URL: link, Thumbnail: thumbnail}, nil
+		})
+	}
+
+	if jobs.OnThisDay {
+		for _, day := range findOnThisDay(immichClient, param, today, fail) {
+			add(day.Album, KindOnThisDay, func() (Message, error) {
+				return onThisDayMessage(immichClient, param, day, link, false)
+			})
+		}
+	}
+
+	if jobs.Digest {
+		digest, batches, err := planDigest(router, immichClient, param, albums, today, fail)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, batch := range batches {
+			pending, err := ledger.Pending(digest, KindDigest, today, []Destination{batch.Destination})
+			if err != nil {
+				fail(fmt.Errorf("erreur registre: %v", err))
+				continue
+			}
+			// Les liens fictifs évitent la création des liens partagés
+			links := make(map[string]string)
+			for _, entry := range batch.Entries {
+				links[entry.Album.ID] = link
+			}
+			msg, err := digestMessage(immichClient, ledger, param, digest.Name, batch.Entries, links)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			messages = append(messages, previewMessage{Kind: KindDigest, Message: msg, Destinations: []string{batch.Destination.Name}, AlreadySent: len(pending) == 0})
+		}
+	}
+	return messages, warnings, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Album du résumé, anniversaire ou nouvel album
+type digestEntry struct {
+	Album Album
+	Kind  string
+	Date  time.Time // Date de l'anniversaire ou de création de l'album
+}
+
+// Fonction pour obtenir les dates de la période du résumé (DIGEST-PERIOD), de start inclus à end exclu :
+//   - week : les anniversaires de la semaine à venir et les albums créés la semaine passée
+//   - month : les anniversaires et les albums créés le mois passé
+func digestPeriod(period string, today time.Time) (anniversariesStart time.Time, anniversariesEnd time.Time, newAlbumsStart time.Time, newAlbumsEnd time.Time) {
+	day := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+	if period == "month" {
+		start := day.AddDate(0, -1, 0)
+		return start, day, start, day
+	}
+	return day, day.AddDate(0, 0, 7), day.AddDate(0, 0, -7), day
+}
+
+// Fonction pour lister les albums du résumé, par date
+func digestEntries(albums []Album, filter *AlbumFilter, rules *AnniversaryRules, period string, today time.Time) []digestEntry {
+	anniversariesStart, anniversariesEnd, newAlbumsStart, newAlbumsEnd := digestPeriod(period, today)
+	var entries []digestEntry
+	for _, album := range albums {
+		if !filter.Selects(album) {
+			continue
+		}
+		for day := anniversariesStart; day.Before(anniversariesEnd); day = day.AddDate(0, 0, 1) {
+			if rules.Matches(album.StartDate, day) {
+				entries = append(entries, digestEntry{Album: album, Kind: KindAnniversary, Date: day})
+			}
+		}
+		if !album.CreatedAt.Before(newAlbumsStart) && album.CreatedAt.Before(newAlbumsEnd) {
+			entries = append(entries, digestEntry{Album: album, Kind: KindNewAlbum, Date: album.CreatedAt})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+	return entries
+}
+
+// Albums du résumé destinés à une destination
+type digestBatch struct {
+	Destination Destination
+	Entries     []digestEntry
+}
+
+// Fonction pour préparer le résumé : l'album fictif utilisé pour le registre, et les albums regroupés par destination, triées par nom.
+// Les erreurs de routage sont passées à fail et n'empêchent pas le regroupement des autres albums.
+func planDigest(router *Router, immichClient *ImmichClient, param *Parameters, albums []Album, today time.Time, fail func(error)) (Album, []digestBatch, error) {
+	title, err := param.Templates.Render("digest-title", TemplateData{Period: param.DigestPeriod})
+	if err != nil {
+		return Album{}, nil, err
+	}
+	digest := Album{ID: "digest-" + param.DigestPeriod + "-" + today.Format(time.DateOnly), Name: title}
+
+	byDestination := make(map[string][]digestEntry)
+	for _, entry := range digestEntries(albums, param.Filter, param.Anniversaries, param.DigestPeriod, today) {
+		destinations, err := router.Route(entry.Album, immichClient)
+		if err != nil {
+			fail(fmt.Errorf("erreur routage: %v", err))
+			continue
+		}
+		for _, destination := range destinations {
+			byDestination[destination.Name] = append(byDestination[destination.Name], entry)
+		}
+	}
+	var batches []digestBatch
+	for _, destination := range router.All() {
+		if entries := byDestination[destination.Name]; len(entries) > 0 {
+			batches = append(batches, digestBatch{Destination: destination, Entries: entries})
+		}
+	}
+	return digest, batches, nil
+}
+
+// Fonction pour envoyer le résumé : chaque destination reçoit un seul message avec les albums qui lui sont destinés.
+// Les envois et les erreurs sont comptés dans summary.
+func sendDigest(router *Router, immichClient *ImmichClient, ledger *Ledger, summary *RunSummary, param *Parameters, albums []Album, today time.Time) {
+	digest, batches, err := planDigest(router, immichClient, param, albums, today, summary.Fail)
+	if err != nil {
+		summary.Fail(err)
+		return
+	}
+	if len(batches) == 0 {
+		fmt.Println("Aucun album pour le résumé")
+		return
+	}
+
+	links := make(map[string]string)
+	for _, batch := range batches {
+		destination := batch.Destination
+		pending, err := ledger.Pending(digest, KindDigest, today, []Destination{destination})
+		if err != nil {
+			summary.Fail(fmt.Errorf("erreur registre: %v", err))
+			continue
+		}
+		if len(pending) == 0 {
+			fmt.Printf("Résumé déjà envoyé à %s\n", destination.Name)
+			continue
+		}
+
+		msg, err := digestMessage(immichClient, ledger, param, digest.Name, batch.Entries, links)
+		if err != nil {
+			summary.Fail(err)
+			continue
+		}
+		if len(notify(pending, msg)) == 0 {
+			summary.Fail(fmt.Errorf("résumé non envoyé à %s", destination.Name))
+			continue
+		}
+		summary.Sent(KindDigest)
+		if err := ledger.Record(digest, KindDigest, today, destination); err != nil {
+			summary.Fail(fmt.Errorf("erreur registre: %v", err))
+		}
+	}
+}
+
+// Fonction pour construire le message du résumé, avec une mosaïque des miniatures des albums.
+// Les liens de partage déjà obtenus sont conservés dans links.
+func digestMessage(immichClient *ImmichClient, ledger *Ledger, param *Parameters, title string, entries []digestEntry, links map[string]string) (Message, error) {
+	data := TemplateData{Period: param.DigestPeriod, AlbumCount: len(entries)}
+	var covers []Asset
+	seen := make(map[string]bool)
+	firstLink := ""
+	for _, entry := range entries {
+		link, ok := links[entry.Album.ID]
+		if !ok {
+			var err error
+			link, err = albumLink(immichClient, ledger, param, entry.Album)
+			if err != nil {
+				return Message{}, fmt.Errorf("erreur récupération clé partage: %v", err)
+			}
+			links[entry.Album.ID] = link
+		}
+		if firstLink == "" {
+			firstLink = link
+		}
+		if entry.Kind == KindAnniversary {
+			data.Anniversaries = append(data.Anniversaries, albumData(entry.Album, link, entry.Date))
+		} else {
+			data.NewAlbums = append(data.NewAlbums, albumData(entry.Album, link, entry.Date))
+		}
+		if entry.Album.AlbumThumbnailAssetId != "" && !seen[entry.Album.AlbumThumbnailAssetId] {
+			seen[entry.Album.AlbumThumbnailAssetId] = true
+			covers = append(covers, Asset{ID: entry.Album.AlbumThumbnailAssetId, FileCreatedAt: entry.Date})
+		}
+	}
+
+	description, err := param.Templates.Render("digest-description", data)
+	if err != nil {
+		return Message{}, err
+	}
+	text, err := param.Templates.Render("digest", data)
+	if err != nil {
+		return Message{}, err
+	}
+
+	// La mosaïque est réduite s'il n'y a pas assez d'albums, une seule miniature est utilisée s'il y en a moins de 4
+	var thumbnail []byte
+	if len(covers) > 0 {
+		thumbnail, err = buildCollage(immichClient, covers, 3)
+		if err == nil && thumbnail == nil {
+			thumbnail, err = immichClient.GetThumbnail(covers[0].ID, SizePreview)
+		}
+		if err != nil {
+			return Message{}, fmt.Errorf("erreur miniature: %v", err)
+		}
+	}
+
+	return Message{
+		Title:       title,
+		Description: description,
+		Text:        text,
+		URL:         firstLink,
+		Thumbnail:   thumbnail,
+	}, nil
+}
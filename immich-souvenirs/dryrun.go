@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Canal qui affiche les messages au lieu de les envoyer, pour --dry-run
+type DryRunNotifier struct {
+	Name   string // Nom du canal remplacé
+	Writer io.Writer
+	Photos bool // Si le canal remplacé envoie les photos
+}
+
+func (n *DryRunNotifier) SendsPhotos() bool {
+	return n.Photos
+}
+
+func (n *DryRunNotifier) Send(target string, msg Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s → %s\n", n.Name, target)
+	fmt.Fprintf(&b, "%s\n", msg.Title)
+	if msg.Description != "" {
+		fmt.Fprintf(&b, "%s\n", msg.Description)
+	}
+	fmt.Fprintf(&b, "%s\n", msg.Text)
+	if len(msg.Thumbnail) > 0 {
+		fmt.Fprintf(&b, "(miniature, %d octets)\n", len(msg.Thumbnail))
+	}
+	if len(msg.Photos) > 0 {
+		fmt.Fprintf(&b, "(%d photo(s))\n", len(msg.Photos))
+	}
+	_, err := io.WriteString(n.Writer, b.String())
+	return err
+}
+
+// Méthode pour remplacer les canaux de toutes les destinations par l'affichage des messages dans w
+func (router *Router) DryRun(w io.Writer) {
+	for name, destination := range router.Destinations {
+		destination.Notifier = &DryRunNotifier{Name: name, Writer: w, Photos: sendsPhotos([]Destination{destination})}
+		router.Destinations[name] = destination
+	}
+}
+
+// Fonction pour obtenir le lien affiché à la place des liens partagés, qui ne sont pas créés lors d'un aperçu ou d'une simulation
+func placeholderLink(param *Parameters) string {
+	return param.ImmichURL + "/share/…"
+}
+
+// Fonction pour obtenir le jour de l'exécution : celui de --date s'il est renseigné, sinon aujourd'hui
+func runDate(param *Parameters) time.Time {
+	if param.Date.IsZero() {
+		return time.Now()
+	}
+	return param.Date
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Marqueur par défaut, dans la description, des albums à ne jamais annoncer
+const defaultHiddenMarker = "#hidden"
+
+// Filtres de sélection des albums annoncés, lus depuis le fichier FILTERS-FILE :
+//
+//	{
+//	  "include": [{"owner": "alice@example.com"}, {"name": "^Famille"}],
+//	  "exclude": [{"name": "(?i)médical"}, {"owner": "bob@example.com", "before": "2015-01-01"}],
+//	  "min_assets": 5,
+//	  "hidden_marker": "#privé"
+//	}
+//
+// Un album partagé est annoncé s'il vérifie au moins une règle include (s'il y en a), aucune règle exclude,
+// s'il contient au moins min_assets photos et si sa description ne contient pas hidden_marker (#hidden par défaut).
+// Les photos des albums, partagés ou non, masqués par hidden_marker ou exclus ne sont pas envoyées dans les souvenirs du jour.
+type AlbumFilter struct {
+	Include      []*AlbumRule `json:"include"`
+	Exclude      []*AlbumRule `json:"exclude"`
+	MinAssets    int          `json:"min_assets"`
+	HiddenMarker string       `json:"hidden_marker"`
+}
+
+// Règle de sélection, tous les critères renseignés doivent être vérifiés
+type AlbumRule struct {
+	Name       string `json:"name"`   // Expression régulière sur le nom de l'album
+	Owner      string `json:"owner"`  // Email, nom ou identifiant du propriétaire de l'album
+	After      string `json:"after"`  // L'album commence ce jour (AAAA-MM-JJ) ou après
+	Before     string `json:"before"` // L'album se termine avant ce jour (AAAA-MM-JJ)
+	nameRegexp *regexp.Regexp
+	after      time.Time
+	before     time.Time
+}
+
+// Fonction pour charger les filtres de FILTERS-FILE, seul le marqueur par défaut est utilisé s'il n'est pas renseigné
+func loadAlbumFilter(param *Parameters) (*AlbumFilter, error) {
+	filter := &AlbumFilter{}
+	if param.FiltersFile != "" {
+		data, err := os.ReadFile(param.FiltersFile)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(filter); err != nil {
+			return nil, fmt.Errorf("invalid filters file '%s': %v", param.FiltersFile, err)
+		}
+	}
+	if filter.HiddenMarker == "" {
+		filter.HiddenMarker = defaultHiddenMarker
+	}
+	for _, rules := range [][]*AlbumRule{filter.Include, filter.Exclude} {
+		for _, rule := range rules {
+			if err := rule.compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return filter, nil
+}
+
+func (rule *AlbumRule) compile() error {
+	var err error
+	if rule.Name != "" {
+		if rule.nameRegexp, err = regexp.Compile(rule.Name); err != nil {
+			return fmt.Errorf("invalid name expression '%s': %v", rule.Name, err)
+		}
+	}
+	if rule.After != "" {
+		if rule.after, err = time.Parse(time.DateOnly, rule.After); err != nil {
+			return fmt.Errorf("invalid after date '%s': %v", rule.After, err)
+		}
+	}
+	if rule.Before != "" {
+		if rule.before, err = time.Parse(time.DateOnly, rule.Before); err != nil {
+			return fmt.Errorf("invalid before date '%s': %v", rule.Before, err)
+		}
+	}
+	return nil
+}
+
+func (rule *AlbumRule) matches(album Album) bool {
+	if rule.nameRegexp != nil && !rule.nameRegexp.MatchString(album.Name) {
+		return false
+	}
+	if rule.Owner != "" && !matchUser(album.Owner, rule.Owner) {
+		return false
+	}
+	if !rule.after.IsZero() && album.StartDate.Before(rule.after) {
+		return false
+	}
+	if !rule.before.IsZero() && !album.EndDate.Before(rule.before) {
+		return false
+	}
+	return true
+}
+
+// Méthode pour vérifier si un album, partagé ou non, est masqué par son marqueur ou exclu par une règle exclude.
+// Ses photos ne sont pas envoyées dans les souvenirs du jour.
+func (filter *AlbumFilter) Hides(album Album) bool {
+	if strings.Contains(strings.ToLower(album.Description), strings.ToLower(filter.HiddenMarker)) {
+		return true
+	}
+	for _, rule := range filter.Exclude {
+		if rule.matches(album) {
+			return true
+		}
+	}
+	return false
+}
+
+// Méthode pour vérifier si un album doit être annoncé
+func (filter *AlbumFilter) Selects(album Album) bool {
+	if !album.Shared {
+		return false
+	}
+	if strings.Contains(strings.ToLower(album.Description), strings.ToLower(filter.HiddenMarker)) {
+		return false
+	}
+	if album.AssetCount < filter.MinAssets {
+		return false
+	}
+	if len(filter.Include) > 0 {
+		included := false
+		for _, rule := range filter.Include {
+			if rule.matches(album) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, rule := range filter.Exclude {
+		if rule.matches(album) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bilan d'une exécution : les messages envoyés par type et les erreurs rencontrées
+type RunSummary struct {
+	Anniversaries int
+	NewAlbums     int
+	OnThisDay     int
+	Digests       int
+	Errors        []string
+}
+
+// Méthode pour compter un message envoyé
+func (s *RunSummary) Sent(kind string) {
+	switch kind {
+	case KindAnniversary:
+		s.Anniversaries++
+	case KindNewAlbum:
+		s.NewAlbums++
+	case KindOnThisDay:
+		s.OnThisDay++
+	case KindDigest:
+		s.Digests++
+	}
+}
+
+// Méthode pour afficher et conserver une erreur
+func (s *RunSummary) Fail(err error) {
+	fmt.Fprintf(os.Stderr, "%v\n", err)
+	s.Errors = append(s.Errors, err.Error())
+}
+
+// Méthode pour ajouter les messages envoyés lors d'une autre tentative
+func (s *RunSummary) Add(other *RunSummary) {
+	s.Anniversaries += other.Anniversaries
+	s.NewAlbums += other.NewAlbums
+	s.OnThisDay += other.OnThisDay
+	s.Digests += other.Digests
+}
+
+// Méthode pour obtenir l'erreur de l'exécution, nil si tout a été envoyé
+func (s *RunSummary) Err() error {
+	if len(s.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d album(s) non envoyé(s)", len(s.Errors))
+}
+
+// Résumé des messages envoyés, comme "3 anniversaries, 1 new album sent"
+func (s *RunSummary) String() string {
+	var parts []string
+	count := func(n int, one string, other string) {
+		if n == 1 {
+			parts = append(parts, "1 "+one)
+		} else if n > 1 {
+			parts = append(parts, strconv.Itoa(n)+" "+other)
+		}
+	}
+	count(s.Anniversaries, "anniversary", "anniversaries")
+	count(s.NewAlbums, "new album", "new albums")
+	count(s.OnThisDay, "on-this-day message", "on-this-day messages")
+	count(s.Digests, "digest", "digests")
+	if len(parts) == 0 {
+		return "nothing sent"
+	}
+	return strings.Join(parts, ", ") + " sent"
+}
+
+// Signalement des exécutions à healthchecks.io (HEALTHCHECKS-URL), sans effet si l'adresse n'est pas renseignée
+type Healthcheck struct {
+	URL    string
+	client *http.Client
+}
+
+func newHealthcheck(url string) *Healthcheck {
+	if url == "" {
+		return nil
+	}
+	return &Healthcheck{URL: strings.TrimSuffix(url, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Méthode pour signaler le début d'une exécution
+func (h *Healthcheck) Start() {
+	h.ping("/start", "")
+}
+
+// Méthode pour signaler le succès d'une exécution, avec son résumé
+func (h *Healthcheck) Success(summary string) {
+	h.ping("", summary)
+}
+
+// Méthode pour signaler l'échec d'une exécution, avec le journal des erreurs
+func (h *Healthcheck) Fail(log string) {
+	h.ping("/fail", log)
+}
+
+// Méthode pour signaler le code de sortie d'une exécution unique, 0 en cas de succès
+func (h *Healthcheck) Exit(status int, body string) {
+	h.ping("/"+strconv.Itoa(status), body)
+}
+
+func (h *Healthcheck) ping(suffix string, body string) {
+	if h == nil {
+		return
+	}
+	res, err := h.client.Post(h.URL+suffix, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck error: %v\n", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "healthcheck error: status code %d\n", res.StatusCode)
+	}
+}
+
+// Fonction pour produire le journal d'une tentative en échec
+func attemptLog(attempt int, err error, summary *RunSummary) string {
+	log := fmt.Sprintf("attempt %d failed: %v\n", attempt, err)
+	if summary != nil {
+		for _, line := range summary.Errors {
+			log += "  " + line + "\n"
+		}
+	}
+	return log
+}
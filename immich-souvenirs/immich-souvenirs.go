@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"math"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -24,165 +22,6 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-type Album struct {
-	ID                    string    `json:"id"`
-	Name                  string    `json:"albumName"`
-	Description           string    `json:"description"`
-	Shared                bool      `json:"shared"`
-	HasSharedLink         bool      `json:"hasSharedLink"`
-	StartDate             time.Time `json:"startDate"`
-	CreatedAt             time.Time `json:"createdAt"`
-	AlbumThumbnailAssetId string    `json:"albumThumbnailAssetId"`
-}
-
-type Key struct {
-	ID    string `json:"id"`
-	Key   string `json:"key"`
-	Album *Album `json:"album"`
-}
-
-type ImmichClient struct {
-	BaseURL string
-	APIKey  string
-}
-
-// Fonction pour créer une instance d'ImmichClient
-func NewImmichClient(baseURL string, apiKey string) *ImmichClient {
-	return &ImmichClient{
-		BaseURL: baseURL,
-		APIKey:  apiKey,
-	}
-}
-
-// Récupérer la liste des albums
-func (ic *ImmichClient) FetchAlbums() ([]Album, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodGet, ic.BaseURL+"/api/albums", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("x-api-key", ic.APIKey)
-	req.Header.Set("Accept", "application/json")
-
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("status code %d", res.StatusCode)
-	}
-
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var albums []Album
-	if err := json.Unmarshal(body, &albums); err != nil {
-		return nil, err
-	}
-	return albums, nil
-}
-
-// Obtenir la clé de partage pour un album
-func (ic *ImmichClient) GetSharingKey(album Album) (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	if album.HasSharedLink {
-		// Récupérer la clé existante
-		req, err := http.NewRequest(http.MethodGet, ic.BaseURL+"/api/shared-links", nil)
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("x-api-key", ic.APIKey)
-		req.Header.Set("Accept", "application/json")
-		res, err := client.Do(req)
-		if err != nil {
-			return "", err
-		}
-		defer res.Body.Close()
-
-		if res.StatusCode != 200 {
-			return "", fmt.Errorf("status code %d", res.StatusCode)
-		}
-
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", err
-		}
-
-		var keys []Key
-		if err := json.Unmarshal(body, &keys); err != nil {
-			return "", err
-		}
-		for _, key := range keys {
-			if key.Album != nil && key.Album.ID == album.ID {
-				return key.Key, nil
-			}
-		}
-		return "", fmt.Errorf("no sharing key found for album '%s'", album.Name)
-	} else {
-		// Créer un nouveau lien partagé
-		jsonData := []byte(`{
-			"albumId": "` + album.ID + `",
-			"allowDownload": true,
-			"allowUpload": false,
-			"showMetadata": true,
-			"type": "ALBUM"
-		}`)
-		req, err := http.NewRequest(http.MethodPost, ic.BaseURL+"/api/shared-links", bytes.NewBuffer(jsonData))
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("x-api-key", ic.APIKey)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/octet-stream")
-		res, err := client.Do(req)
-		if err != nil {
-			return "", err
-		}
-		defer res.Body.Close()
-
-		if res.StatusCode != 201 {
-			return "", fmt.Errorf("status code %d", res.StatusCode)
-		}
-
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			return "", err
-		}
-
-		var key Key
-		if err := json.Unmarshal(body, &key); err != nil {
-			return "", err
-		}
-		return key.Key, nil
-	}
-}
-
-// Récupérer la miniature d'un album
-func (ic *ImmichClient) GetThumbnail(assetID string) ([]byte, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodGet, ic.BaseURL+"/api/assets/"+assetID+"/thumbnail?size=preview", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("x-api-key", ic.APIKey)
-	req.Header.Set("Accept", "application/octet-stream")
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("status code %d", res.StatusCode)
-	}
-
-	return io.ReadAll(res.Body)
-}
-
 type WhatsAppClient struct {
 	Client *whatsmeow.Client
 }
@@ -251,14 +90,155 @@ func (wac *WhatsAppClient) SendMessage(group string, title string, description s
 	return nil
 }
 
+// Méthode pour envoyer des photos, chacune avec sa légende, en réessayant chaque envoi jusqu'à 3 fois
+func (wac *WhatsAppClient) SendPhotos(group string, photos []Photo) error {
+	jid, err := types.ParseJID(group)
+	if err != nil {
+		return fmt.Errorf("incorrect group identifier '%s': %v", group, err)
+	}
+
+	for i, photo := range photos {
+		for attempt := 1; ; attempt++ {
+			err = wac.sendPhoto(jid, photo)
+			if err == nil || attempt == 3 {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+		if err != nil && i == 0 {
+			return fmt.Errorf("error sending photo 1 of %d: %v", len(photos), err)
+		}
+		if err != nil {
+			// La première photo porte le titre et le lien : le message est considéré comme envoyé, pour ne pas le renvoyer en entier
+			fmt.Fprintf(os.Stderr, "warning: only %d of %d photo(s) sent to '%s', error sending photo %d: %v\n", i, len(photos), group, i+1, err)
+			return nil
+		}
+	}
+	fmt.Printf("%d photo(s) sent\n", len(photos))
+	return nil
+}
+
+func (wac *WhatsAppClient) sendPhoto(jid types.JID, photo Photo) error {
+	uploaded, err := wac.Client.Upload(context.Background(), photo.Data, whatsmeow.MediaImage)
+	if err != nil {
+		return fmt.Errorf("upload failed: %v", err)
+	}
+	msg := &waProto.Message{
+		ImageMessage: &waProto.ImageMessage{
+			Caption:       proto.String(photo.Caption),
+			Mimetype:      proto.String("image/jpeg"),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uploaded.FileLength),
+			Width:         proto.Uint32(uint32(photo.Width)),
+			Height:        proto.Uint32(uint32(photo.Height)),
+			JPEGThumbnail: photo.Thumbnail,
+		},
+	}
+	_, err = wac.Client.SendMessage(context.Background(), jid, msg)
+	return err
+}
+
+// Méthode pour envoyer un message avec un lien vers l'album et sa miniature, ou avec ses photos s'il y en a.
+// Dans ce cas, la première légende contient le titre et le lien.
+func (wac *WhatsAppClient) Send(group string, msg Message) error {
+	if len(msg.Photos) == 0 {
+		return wac.SendMessage(group, msg.Title, msg.Description, msg.Text, msg.URL, msg.Thumbnail)
+	}
+	photos := append([]Photo(nil), msg.Photos...)
+	photos[0].Caption = msg.Title + "\n" + msg.Text
+	return wac.SendPhotos(group, photos)
+}
+
+// Méthode pour indiquer que WhatsApp envoie les photos des messages
+func (wac *WhatsAppClient) SendsPhotos() bool {
+	return true
+}
+
+// Méthode pour se connecter si nécessaire
+func (wac *WhatsAppClient) Connect() error {
+	if wac.Client.IsConnected() {
+		return nil
+	}
+	return wac.Client.Connect()
+}
+
+// Méthode pour se déconnecter
+func (wac *WhatsAppClient) Disconnect() {
+	wac.Client.Disconnect()
+}
+
+// Méthode pour vérifier l'état de la session : elle doit être appairée, et toujours valide si elle est connectée.
+// La connexion n'est ouverte que pendant les exécutions, elle n'est donc pas vérifiée.
+func (wac *WhatsAppClient) CheckSession() error {
+	if wac.Client.Store.ID == nil {
+		return fmt.Errorf("session not paired")
+	}
+	if wac.Client.IsConnected() && !wac.Client.IsLoggedIn() {
+		return fmt.Errorf("session logged out")
+	}
+	return nil
+}
+
 type Parameters struct {
-	ImmichURL           string
-	ImmichKey           string
-	WhatsappSessionFile string
-	WhatsappGroup       string
-	TimeToRun           string
-	DevelopmentMode     string
-	HealthchecksURL     string
+	ImmichURL            string
+	ImmichKey            string
+	ImmichTimeout        string
+	ImmichConnectTimeout string
+	WhatsappSessionFile  string
+	WhatsappGroup        string
+	TimeToRun            string
+	Schedules            string
+	OnThisDayYears       string
+	AnniversaryYears     string
+	AnniversaryFeb29     string
+	AnniversaryDate      string
+	Anniversaries        *AnniversaryRules // Chargées depuis les paramètres ANNIVERSARY-*
+	Collage              string
+	DigestPeriod         string
+	Language             string
+	TemplatesFile        string
+	Templates            *Templates // Chargés depuis MESSAGE-LANGUAGE et TEMPLATES-FILE
+	FiltersFile          string
+	Filter               *AlbumFilter // Chargé depuis FILTERS-FILE
+	LinkAllowDownload    string
+	LinkAllowUpload      string
+	LinkShowMetadata     string
+	LinkPassword         string
+	LinkExpiryDays       string
+	LinkPolicy           *LinkPolicy // Chargée depuis les paramètres LINK-*
+	WhatsappPhotos       string
+	TimeZone             string
+	DevelopmentMode      string
+	HealthchecksURL      string
+	HTTPListen           string
+	HTTPToken            string
+	DryRun               bool      // --dry-run
+	Date                 time.Time // --date, zéro pour aujourd'hui
+	LedgerFile           string
+	Notifiers            string
+	RoutesFile           string
+	TelegramToken        string
+	TelegramChatID       string
+	MatrixURL            string
+	MatrixToken          string
+	MatrixRoom           string
+	SignalURL            string
+	SignalNumber         string
+	SignalRecipients     string
+	DiscordWebhook       string
+	SlackWebhook         string
+	NtfyURL              string
+	NtfyTopic            string
+	NtfyToken            string
+	SMTPServer           string
+	SMTPUsername         string
+	SMTPPassword         string
+	SMTPFrom             string
+	SMTPTo               string
 }
 
 func parseTime(timeStr string) (int, int, error) {
@@ -287,93 +267,295 @@ func main() {
 		os.Exit(0)
 	}()
 
+	// Parse the flags, the remaining arguments are the command
+	dryRun := flag.Bool("dry-run", false, "Print the messages instead of sending them, without creating shared links or updating the ledger")
+	date := flag.String("date", "", "Run once as if today was this date (YYYY-MM-DD)")
+	flag.Parse()
+	args := flag.Args()
+
 	// Load parameters from environment variables
 	param := &Parameters{
-		ImmichURL:           os.Getenv("IMMICH-URL"),
-		ImmichKey:           os.Getenv("IMMICH-KEY"),
-		WhatsappSessionFile: os.Getenv("WHATSAPP-SESSION-FILE"),
-		WhatsappGroup:       os.Getenv("WHATSAPP-GROUP"),
-		TimeToRun:           os.Getenv("TIME-TO-RUN"),
-		DevelopmentMode:     os.Getenv("DEVELOPMENT-MODE"),
-		HealthchecksURL:     os.Getenv("HEALTHCHECKS-URL"),
+		ImmichURL:            os.Getenv("IMMICH-URL"),
+		ImmichKey:            os.Getenv("IMMICH-KEY"),
+		ImmichTimeout:        os.Getenv("IMMICH-TIMEOUT"),
+		ImmichConnectTimeout: os.Getenv("IMMICH-CONNECT-TIMEOUT"),
+		WhatsappSessionFile:  os.Getenv("WHATSAPP-SESSION-FILE"),
+		WhatsappGroup:        os.Getenv("WHATSAPP-GROUP"),
+		TimeToRun:            os.Getenv("TIME-TO-RUN"),
+		Schedules:            os.Getenv("SCHEDULES"),
+		OnThisDayYears:       os.Getenv("ON-THIS-DAY-YEARS"),
+		AnniversaryYears:     os.Getenv("ANNIVERSARY-YEARS"),
+		AnniversaryFeb29:     os.Getenv("ANNIVERSARY-FEB29"),
+		AnniversaryDate:      os.Getenv("ANNIVERSARY-DATE"),
+		Collage:              os.Getenv("COLLAGE"),
+		DigestPeriod:         os.Getenv("DIGEST-PERIOD"),
+		Language:             os.Getenv("MESSAGE-LANGUAGE"),
+		TemplatesFile:        os.Getenv("TEMPLATES-FILE"),
+		FiltersFile:          os.Getenv("FILTERS-FILE"),
+		LinkAllowDownload:    os.Getenv("LINK-ALLOW-DOWNLOAD"),
+		LinkAllowUpload:      os.Getenv("LINK-ALLOW-UPLOAD"),
+		LinkShowMetadata:     os.Getenv("LINK-SHOW-METADATA"),
+		LinkPassword:         os.Getenv("LINK-PASSWORD"),
+		LinkExpiryDays:       os.Getenv("LINK-EXPIRY-DAYS"),
+		WhatsappPhotos:       os.Getenv("WHATSAPP-PHOTOS"),
+		TimeZone:             os.Getenv("TZ"),
+		DevelopmentMode:      os.Getenv("DEVELOPMENT-MODE"),
+		HealthchecksURL:      os.Getenv("HEALTHCHECKS-URL"),
+		HTTPListen:           os.Getenv("HTTP-LISTEN"),
+		HTTPToken:            os.Getenv("HTTP-TOKEN"),
+		LedgerFile:           os.Getenv("LEDGER-FILE"),
+		Notifiers:            os.Getenv("NOTIFIERS"),
+		RoutesFile:           os.Getenv("ROUTES-FILE"),
+		TelegramToken:        os.Getenv("TELEGRAM-TOKEN"),
+		TelegramChatID:       os.Getenv("TELEGRAM-CHAT-ID"),
+		MatrixURL:            os.Getenv("MATRIX-URL"),
+		MatrixToken:          os.Getenv("MATRIX-TOKEN"),
+		MatrixRoom:           os.Getenv("MATRIX-ROOM"),
+		SignalURL:            os.Getenv("SIGNAL-URL"),
+		SignalNumber:         os.Getenv("SIGNAL-NUMBER"),
+		SignalRecipients:     os.Getenv("SIGNAL-RECIPIENTS"),
+		DiscordWebhook:       os.Getenv("DISCORD-WEBHOOK"),
+		SlackWebhook:         os.Getenv("SLACK-WEBHOOK"),
+		NtfyURL:              os.Getenv("NTFY-URL"),
+		NtfyTopic:            os.Getenv("NTFY-TOPIC"),
+		NtfyToken:            os.Getenv("NTFY-TOKEN"),
+		SMTPServer:           os.Getenv("SMTP-SERVER"),
+		SMTPUsername:         os.Getenv("SMTP-USERNAME"),
+		SMTPPassword:         os.Getenv("SMTP-PASSWORD"),
+		SMTPFrom:             os.Getenv("SMTP-FROM"),
+		SMTPTo:               os.Getenv("SMTP-TO"),
 	}
-
-	// Initialize WhatsApp connection
-	wac, err := NewWhatsAppClient(param.WhatsappSessionFile)
+	if param.Notifiers == "" {
+		param.Notifiers = "whatsapp"
+	}
+	if _, err := parseCollageGrid(param.Collage); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	if _, err := photoCount(param); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	templates, err := loadTemplates(param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading the templates: %v\n", err)
+		return
+	}
+	param.Templates = templates
+	filter, err := loadAlbumFilter(param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading the filters: %v\n", err)
+		return
+	}
+	param.Filter = filter
+	linkPolicy, err := loadLinkPolicy(param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	param.LinkPolicy = linkPolicy
+	anniversaries, err := loadAnniversaryRules(param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	param.Anniversaries = anniversaries
+	timeout, connectTimeout, err := immichTimeouts(param)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error initializing WhatsApp: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+
+	param.DryRun = *dryRun
+	if *date != "" {
+		location, err := loadLocation(param)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time zone: %v\n", err)
+			return
+		}
+		param.Date, err = time.ParseInLocation(time.DateOnly, *date, location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid date '%s', it must look like YYYY-MM-DD\n", *date)
+			return
+		}
+	}
+
+	if param.DigestPeriod == "" {
+		param.DigestPeriod = "week"
+	} else if param.DigestPeriod != "week" && param.DigestPeriod != "month" {
+		fmt.Fprintf(os.Stderr, "invalid DIGEST-PERIOD '%s', it must be week or month\n", param.DigestPeriod)
 		return
 	}
 
 	// Initialize Immich client
-	immichClient := NewImmichClient(param.ImmichURL, param.ImmichKey)
+	immichClient := NewImmichClient(param.ImmichURL, param.ImmichKey, timeout, connectTimeout)
 
-	switch param.DevelopmentMode {
-	case "run-once", "run-last":
-		if err := runLoop(wac, immichClient, param); err != nil {
-			fmt.Fprintf(os.Stderr, "error in runLoop: %v\n", err)
+	// Show the ledger of the messages sent
+	if len(args) > 0 && args[0] == "ledger" {
+		if err := ledgerCommand(param, args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading the ledger: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Revoke the shared links created by the tool
+	if len(args) > 0 && args[0] == "cleanup-links" {
+		if err := cleanupLinksCommand(param, immichClient, args[1:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "error cleaning up the shared links: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if param.DevelopmentMode == "listen" {
+		wac, err := NewWhatsAppClient(param.WhatsappSessionFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error initializing WhatsApp: %v\n", err)
+			return
 		}
-	case "listen":
 		if err := listen(wac); err != nil {
 			fmt.Fprintf(os.Stderr, "error in listen: %v\n", err)
 		}
+		return
+	}
+
+	// Initialize the notifiers and the routes
+	router, err := newRouter(param)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error initializing notifiers: %v\n", err)
+		return
+	}
+
+	// Print the messages instead of sending them
+	if param.DryRun {
+		router.DryRun(os.Stdout)
+	}
+
+	switch {
+	case param.DevelopmentMode == "run-once", param.DevelopmentMode == "run-last", param.DryRun, !param.Date.IsZero():
+		// Run the jobs of all the schedules once
+		jobs := defaultJobs
+		if param.Schedules != "" {
+			schedules, err := parseSchedules(param)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return
+			}
+			jobs = scheduledJobs(schedules)
+		}
+		// A dry run is not reported
+		healthcheck := newHealthcheck(param.HealthchecksURL)
+		if param.DryRun {
+			healthcheck = nil
+		}
+		healthcheck.Start()
+		summary, err := runLoop(router, immichClient, param, jobs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error in runLoop: %v\n", err)
+			healthcheck.Exit(1, attemptLog(1, err, summary))
+			os.Exit(1)
+		}
+		fmt.Println(summary)
+		healthcheck.Exit(0, summary.String())
 	default:
 		// Test connection on startup
-		if err := testConnections(wac, immichClient, param); err != nil {
+		if err := testConnections(router, immichClient, param); err != nil {
 			fmt.Fprintf(os.Stderr, "connection test failed: %v\n", err)
 			return
 		}
 		// Main scheduled loop
-		for {
-			hours, minutes, err := parseTime(param.TimeToRun)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "invalid time format: %v\n", err)
-				return
-			}
-			now := time.Now()
-			target := time.Date(now.Year(), now.Month(), now.Day(), hours, minutes, 0, 0, now.Location())
-			if target.Before(now) {
-				target = target.Add(24 * time.Hour)
-			}
-			sleepDuration := target.Sub(now)
-			fmt.Printf("Sleeping for: %v\n", sleepDuration)
-			time.Sleep(sleepDuration)
-
-			// Retry logic
-			for i := 0; i < 3; i++ {
-				err := runLoop(wac, immichClient, param)
-				if err == nil {
-					break
+		schedules, err := parseSchedules(param)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+		location, err := loadLocation(param)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time zone: %v\n", err)
+			return
+		}
+		// Only one run at a time, even if several schedules are due together
+		var mutex sync.Mutex
+		_, err = startScheduler(schedules, location, func(jobs Jobs) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			scheduledRun(router, immichClient, param, jobs)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return
+		}
+		// Runs triggered through the control server are refused while another one is in progress
+		if param.HTTPListen != "" {
+			tryRun := func(jobs Jobs) bool {
+				if !mutex.TryLock() {
+					return false
 				}
-				fmt.Fprintf(os.Stderr, "attempt %d failed: %v\n", i+1, err)
-				time.Sleep(time.Duration(math.Pow(2, float64(i))) * 30 * time.Second)
+				go func() {
+					defer mutex.Unlock()
+					scheduledRun(router, immichClient, param, jobs)
+				}()
+				return true
 			}
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error after retries: %v\n", err)
-			} else if param.HealthchecksURL != "" {
-				client := &http.Client{Timeout: 10 * time.Second}
-				_, err := client.Head(param.HealthchecksURL)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "healthcheck error: %v\n", err)
-				}
+			if err := startControlServer(router, immichClient, param, scheduledJobs(schedules), tryRun); err != nil {
+				fmt.Fprintf(os.Stderr, "error in control server: %v\n", err)
 			}
+			return
 		}
+		select {}
 	}
 }
 
-// Fonction pour tester la connexion à WhatsApp et Immich
-func testConnections(wac *WhatsAppClient, immichClient *ImmichClient, param *Parameters) error {
-	fmt.Println("Testing connections...")
-	// Connecter WhatsApp si nécessaire
-	if !wac.Client.IsConnected() {
-		if err := wac.Client.Connect(); err != nil {
-			return err
+// Fonction pour une exécution planifiée, avec nouvelles tentatives en cas d'erreur.
+// Le début, l'échec (avec le journal des erreurs) ou le succès (avec le résumé des envois) sont signalés à HEALTHCHECKS-URL.
+func scheduledRun(router *Router, immichClient *ImmichClient, param *Parameters, jobs Jobs) {
+	healthcheck := newHealthcheck(param.HealthchecksURL)
+	healthcheck.Start()
+	start := time.Now()
+
+	// Retry logic
+	var err error
+	var log string
+	total := &RunSummary{}
+	for i := 0; i < 3; i++ {
+		var summary *RunSummary
+		summary, err = runLoop(router, immichClient, param, jobs)
+		total.Add(summary)
+		if err == nil {
+			break
 		}
+		fmt.Fprintf(os.Stderr, "attempt %d failed: %v\n", i+1, err)
+		log += attemptLog(i+1, err, summary)
+		time.Sleep(time.Duration(math.Pow(2, float64(i))) * 30 * time.Second)
 	}
-	defer wac.Client.Disconnect()
-	fmt.Println("WhatsApp connected.")
+	runMetrics.Record(total, err, start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error after retries: %v\n", err)
+		healthcheck.Fail(log)
+		return
+	}
+	fmt.Println(total)
+	healthcheck.Success(total.String())
+}
+
+// Fonction pour tester la connexion aux canaux et à Immich
+func testConnections(router *Router, immichClient *ImmichClient, param *Parameters) error {
+	fmt.Println("Testing connections...")
+	// Connecter les canaux si nécessaire
+	disconnect, err := connectDestinations(router.All())
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	fmt.Println("Notifiers connected.")
 
 	// Test Immich
+	version, err := immichClient.CheckVersion()
+	if err != nil {
+		return fmt.Errorf("immich connection failed: %v", err)
+	}
+	fmt.Printf("Immich version %s.\n", version)
 	albums, err := immichClient.FetchAlbums()
 	if err != nil {
 		return fmt.Errorf("immich connection failed: %v", err)
@@ -383,76 +565,188 @@ func testConnections(wac *WhatsAppClient, immichClient *ImmichClient, param *Par
 }
 
 // Fonction principale pour exécuter la logique
-func runLoop(wac *WhatsAppClient, immichClient *ImmichClient, param *Parameters) error {
-	// Connecter WhatsApp si nécessaire
-	if !wac.Client.IsConnected() {
-		if err := wac.Client.Connect(); err != nil {
-			return err
-		}
+func runLoop(router *Router, immichClient *ImmichClient, param *Parameters, jobs Jobs) (*RunSummary, error) {
+	summary := &RunSummary{}
+	// Connecter les canaux si nécessaire
+	disconnect, err := connectDestinations(router.All())
+	if err != nil {
+		return summary, err
 	}
-	defer wac.Client.Disconnect()
+	defer disconnect()
 
-	// Charger albums depuis Immich
+	// Ouvrir le registre des envois, qui n'est pas consulté en mode run-last qui renvoie toujours le dernier album
+	ledger, err := OpenLedger(ledgerFile(param))
+	if err != nil {
+		return summary, err
+	}
+	defer ledger.Close()
+	ledger.Replay = param.DevelopmentMode == "run-last"
+	ledger.ReadOnly = param.DryRun
+
+	if _, err := immichClient.CheckVersion(); err != nil {
+		return summary, err
+	}
+
+	// Révoquer les liens partagés expirés, sauf pour une simulation
+	if !param.DryRun {
+		revokeExpiredLinks(immichClient, ledger, time.Now())
+	}
+
+	// Charger albums depuis Immich, les tags utilisés par le routage sont rechargés
+	router.ResetTags()
 	albums, err := immichClient.FetchAlbums()
 	if err != nil {
-		return err
+		return summary, err
+	}
+
+	if jobs.Anniversaries || jobs.Digest {
+		applyAssetDates(immichClient, param.Anniversaries, albums, param.Filter.Selects)
+	}
+
+	today := runDate(param)
+	if param.DevelopmentMode == "run-last" {
+		// Envoyer le premier album comme un anniversaire
+		for _, album := range albums {
+			if !param.Filter.Selects(album) {
+				continue
+			}
+			err := sendAlbum(router, immichClient, ledger, summary, param, album, KindAnniversary, today, func(link string) (string, error) {
+				return param.Templates.Render("anniversary", albumData(album, link, today))
+			})
+			if err != nil {
+				summary.Fail(err)
+				continue
+			}
+			return summary, nil
+		}
+		return summary, summary.Err()
+	}
+
+	// Envoyer les albums anniversaire et les albums de la veille
+	for _, entry := range dueAlbums(albums, param, jobs, today) {
+		err := sendAlbum(router, immichClient, ledger, summary, param, entry.Album, entry.Kind, today, func(link string) (string, error) {
+			return albumText(param, entry, link)
+		})
+		if err != nil {
+			summary.Fail(err)
+		}
+	}
+
+	// Récupérer les photos prises ce jour les années précédentes
+	if jobs.OnThisDay {
+		sendOnThisDay(router, immichClient, ledger, summary, param, today)
+	}
+
+	// Envoyer le résumé de la période
+	if jobs.Digest {
+		sendDigest(router, immichClient, ledger, summary, param, albums, today)
 	}
 
+	return summary, summary.Err()
+}
+
+// Fonction pour lister les albums à annoncer ce jour : les anniversaires, puis les albums créés la veille
+func dueAlbums(albums []Album, param *Parameters, jobs Jobs, today time.Time) []digestEntry {
+	var anniversaries, newAlbums []digestEntry
+	yesterday := today.AddDate(0, 0, -1)
 	for _, album := range albums {
-		if album.Shared {
-			// Récupérer les albums anniversaire
-			if param.DevelopmentMode == "run-last" || (album.StartDate.Month() == time.Now().Month() && album.StartDate.Day() == time.Now().Day()) {
-				// Obtenir la clé de partage
-				sharingKey, err := immichClient.GetSharingKey(album)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur récupération clé partage: %v\n", err)
-					continue
-				}
-				link := param.ImmichURL + "/share/" + sharingKey
+		if !param.Filter.Selects(album) {
+			continue
+		}
+		if jobs.Anniversaries && param.Anniversaries.Matches(album.StartDate, today) {
+			anniversaries = append(anniversaries, digestEntry{Album: album, Kind: KindAnniversary, Date: today})
+		}
+		if jobs.NewAlbums && album.CreatedAt.Year() == yesterday.Year() && album.CreatedAt.Month() == yesterday.Month() && album.CreatedAt.Day() == yesterday.Day() {
+			newAlbums = append(newAlbums, digestEntry{Album: album, Kind: KindNewAlbum, Date: album.CreatedAt})
+		}
+	}
+	return append(anniversaries, newAlbums...)
+}
 
-				// Récupérer la miniature
-				thumbnail, err := immichClient.GetThumbnail(album.AlbumThumbnailAssetId)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur miniature: %v\n", err)
-					continue
-				}
+// Fonction pour produire le texte d'un album à annoncer, avec le modèle de son type
+func albumText(param *Parameters, entry digestEntry, link string) (string, error) {
+	return param.Templates.Render(entry.Kind, albumData(entry.Album, link, entry.Date))
+}
 
-				// Envoyer le message
-				err = wac.SendMessage(param.WhatsappGroup, album.Name, album.Description, fmt.Sprintf("Il y a %d an(s) : %s", time.Now().Year()-album.StartDate.Year(), link), link, thumbnail)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur envoi WhatsApp: %v\n", err)
-				}
-			}
+// Fonction pour envoyer un album avec son lien de partage et sa miniature
+func sendAlbum(router *Router, immichClient *ImmichClient, ledger *Ledger, summary *RunSummary, param *Parameters, album Album, kind string, date time.Time, text func(link string) (string, error)) error {
+	return send(router, immichClient, ledger, summary, album, kind, date, func(destinations []Destination) (Message, error) {
+		// Obtenir le lien de partage
+		link, err := albumLink(immichClient, ledger, param, album)
+		if err != nil {
+			return Message{}, fmt.Errorf("erreur récupération clé partage: %v", err)
+		}
+
+		// Récupérer la miniature
+		thumbnail, err := albumThumbnail(immichClient, param, album)
+		if err != nil {
+			return Message{}, fmt.Errorf("erreur miniature: %v", err)
+		}
 
-			if param.DevelopmentMode == "run-last" {
-				return nil
+		// Récupérer les photos à envoyer avec le message, si une des destinations les envoie
+		var photos []Photo
+		if count, _ := photoCount(param); count > 0 && sendsPhotos(destinations) {
+			assets, err := immichClient.FetchAlbumAssets(album.ID)
+			if err != nil {
+				return Message{}, fmt.Errorf("erreur récupération photos: %v", err)
+			}
+			photos, err = fetchPhotos(immichClient, param, assets, count)
+			if err != nil {
+				return Message{}, fmt.Errorf("erreur récupération photos: %v", err)
 			}
+		}
 
-			// Récupérer les albums de la veille
-			if album.CreatedAt.Year() == time.Now().AddDate(0, 0, -1).Year() && (album.CreatedAt.Month() == time.Now().AddDate(0, 0, -1).Month()) && (album.CreatedAt.Day() == time.Now().AddDate(0, 0, -1).Day()) {
-				// Obtenir la clé de partage
-				sharingKey, err := immichClient.GetSharingKey(album)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur récupération clé partage: %v\n", err)
-					continue
-				}
-				link := param.ImmichURL + "/share/" + sharingKey
+		message, err := text(link)
+		if err != nil {
+			return Message{}, err
+		}
 
-				// Récupérer la miniature
-				thumbnail, err := immichClient.GetThumbnail(album.AlbumThumbnailAssetId)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur miniature: %v\n", err)
-					continue
-				}
+		return Message{
+			Title:       album.Name,
+			Description: album.Description,
+			Text:        message,
+			URL:         link,
+			Thumbnail:   thumbnail,
+			Photos:      photos,
+		}, nil
+	})
+}
 
-				// Envoyer le message
-				err = wac.SendMessage(param.WhatsappGroup, album.Name, album.Description, fmt.Sprintf("Nouvel album : %s", link), link, thumbnail)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "erreur envoi WhatsApp: %v\n", err)
-				}
-			}
+// Fonction pour envoyer un message aux destinations de l'album qui ne l'ont pas encore reçu ce jour.
+// Le message n'est construit que s'il reste des destinations, il est compté dans summary s'il a été envoyé.
+func send(router *Router, immichClient *ImmichClient, ledger *Ledger, summary *RunSummary, album Album, kind string, date time.Time, build func(destinations []Destination) (Message, error)) error {
+	// Choisir les destinations
+	destinations, err := router.Route(album, immichClient)
+	if err != nil {
+		return fmt.Errorf("erreur routage: %v", err)
+	}
+	destinations, err = ledger.Pending(album, kind, date, destinations)
+	if err != nil {
+		return fmt.Errorf("erreur registre: %v", err)
+	}
+	if len(destinations) == 0 {
+		fmt.Printf("Album '%s' déjà envoyé\n", album.Name)
+		return nil
+	}
+
+	msg, err := build(destinations)
+	if err != nil {
+		return err
+	}
+
+	// Envoyer le message et l'enregistrer pour chaque destination
+	sent := notify(destinations, msg)
+	if len(sent) > 0 {
+		summary.Sent(kind)
+	}
+	for _, destination := range sent {
+		if err := ledger.Record(album, kind, date, destination); err != nil {
+			return fmt.Errorf("erreur registre: %v", err)
 		}
 	}
+	if len(sent) < len(destinations) {
+		return fmt.Errorf("album '%s' non envoyé à %d destination(s)", album.Name, len(destinations)-len(sent))
+	}
 	return nil
 }
 
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version minimale d'Immich, pour les tags hiérarchiques, la recherche par tag et les miniatures "preview"
+var minImmichVersion = ImmichVersion{Major: 1, Minor: 118}
+
+type Album struct {
+	ID                    string    `json:"id"`
+	Name                  string    `json:"albumName"`
+	Description           string    `json:"description"`
+	Shared                bool      `json:"shared"`
+	HasSharedLink         bool      `json:"hasSharedLink"`
+	StartDate             time.Time `json:"startDate"`
+	CreatedAt             time.Time `json:"createdAt"`
+	AlbumThumbnailAssetId string    `json:"albumThumbnailAssetId"`
+	AssetCount            int       `json:"assetCount"`
+	EndDate               time.Time `json:"endDate"`
+	Owner                 User      `json:"owner"`
+	AlbumUsers            []struct {
+		User User   `json:"user"`
+		Role string `json:"role"`
+	} `json:"albumUsers"`
+}
+
+type User struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type Asset struct {
+	ID               string    `json:"id"`
+	Type             string    `json:"type"`
+	OriginalFileName string    `json:"originalFileName"`
+	FileCreatedAt    time.Time `json:"fileCreatedAt"`
+	LocalDateTime    time.Time `json:"localDateTime"` // Date de prise de vue à l'heure locale, notée UTC
+	IsFavorite       bool      `json:"isFavorite"`
+}
+
+// Méthode pour obtenir la date de prise de vue à l'heure locale, ou la date de création si elle est inconnue
+func (a Asset) Date() time.Time {
+	if a.LocalDateTime.IsZero() {
+		return a.FileCreatedAt
+	}
+	return a.LocalDateTime
+}
+
+type Tag struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Key struct {
+	ID        string     `json:"id"`
+	Key       string     `json:"key"`
+	Album     *Album     `json:"album"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+// Méthode pour vérifier si le lien a expiré
+func (k Key) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !k.ExpiresAt.After(now)
+}
+
+type ImmichVersion struct {
+	Major int `json:"major"`
+	Minor int `json:"minor"`
+	Patch int `json:"patch"`
+}
+
+func (v ImmichVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Méthode pour vérifier si la version est antérieure à other
+func (v ImmichVersion) Before(other ImmichVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// Erreur renvoyée par l'API d'Immich
+type ImmichError struct {
+	StatusCode    int
+	Message       string
+	CorrelationID string
+}
+
+func (e *ImmichError) Error() string {
+	message := fmt.Sprintf("status code %d", e.StatusCode)
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	if e.CorrelationID != "" {
+		message += " (correlation id " + e.CorrelationID + ")"
+	}
+	return message
+}
+
+// Fonction pour lire l'erreur d'une réponse d'Immich, de la forme {"message": "...", "correlationId": "..."}.
+// Le message peut être une liste pour les erreurs de validation.
+func readImmichError(res *http.Response) error {
+	immichError := &ImmichError{StatusCode: res.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	var content struct {
+		Message       json.RawMessage `json:"message"`
+		CorrelationID string          `json:"correlationId"`
+	}
+	if err := json.Unmarshal(body, &content); err != nil {
+		immichError.Message = strings.TrimSpace(string(body))
+		return immichError
+	}
+	immichError.CorrelationID = content.CorrelationID
+	var messages []string
+	if err := json.Unmarshal(content.Message, &immichError.Message); err != nil && json.Unmarshal(content.Message, &messages) == nil {
+		immichError.Message = strings.Join(messages, ", ")
+	}
+	return immichError
+}
+
+// Fonction pour vérifier si l'erreur est une réponse d'Immich avec ce code
+func isImmichStatus(err error, statusCode int) bool {
+	var immichError *ImmichError
+	return errors.As(err, &immichError) && immichError.StatusCode == statusCode
+}
+
+type ImmichClient struct {
+	BaseURL string
+	APIKey  string
+	client  *http.Client
+	version *ImmichVersion
+}
+
+// Fonction pour créer une instance d'ImmichClient : timeout limite la durée de chaque requête, connectTimeout celle de la connexion
+func NewImmichClient(baseURL string, apiKey string, timeout time.Duration, connectTimeout time.Duration) *ImmichClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	return &ImmichClient{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+	}
+}
+
+// Fonction pour lire les délais d'Immich en secondes : IMMICH-TIMEOUT (30 par défaut) et IMMICH-CONNECT-TIMEOUT (10 par défaut)
+func immichTimeouts(param *Parameters) (timeout time.Duration, connectTimeout time.Duration, err error) {
+	parse := func(name string, value string, defaultValue int) (time.Duration, error) {
+		if value == "" {
+			return time.Duration(defaultValue) * time.Second, nil
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return 0, fmt.Errorf("invalid %s '%s'", name, value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if timeout, err = parse("IMMICH-TIMEOUT", param.ImmichTimeout, 30); err != nil {
+		return 0, 0, err
+	}
+	if connectTimeout, err = parse("IMMICH-CONNECT-TIMEOUT", param.ImmichConnectTimeout, 10); err != nil {
+		return 0, 0, err
+	}
+	return timeout, connectTimeout, nil
+}
+
+// Envoyer une requête à l'API, body est encodé en JSON s'il n'est pas nil.
+// Les réponses en erreur sont renvoyées comme ImmichError, le corps de la réponse doit être fermé par l'appelant.
+func (ic *ImmichClient) request(method string, path string, query url.Values, body interface{}, accept string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(jsonData)
+	}
+	endpoint := ic.BaseURL + "/api" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", ic.APIKey)
+	req.Header.Set("Accept", accept)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := ic.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, readImmichError(res)
+	}
+	return res, nil
+}
+
+// Appeler l'API et décoder la réponse JSON dans result, sauf s'il est nil
+func (ic *ImmichClient) call(method string, path string, query url.Values, body interface{}, result interface{}) error {
+	res, err := ic.request(method, path, query, body, "application/json")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// Récupérer la version du serveur
+func (ic *ImmichClient) ServerVersion() (ImmichVersion, error) {
+	var version ImmichVersion
+	err := ic.call(http.MethodGet, "/server/version", nil, nil, &version)
+	return version, err
+}
+
+// Vérifier que la version du serveur est prise en charge, une seule fois
+func (ic *ImmichClient) CheckVersion() (ImmichVersion, error) {
+	if ic.version != nil {
+		return *ic.version, nil
+	}
+	version, err := ic.ServerVersion()
+	if err != nil {
+		return version, err
+	}
+	if version.Before(minImmichVersion) {
+		return version, fmt.Errorf("immich version %s is not supported, %s or later is required", version, minImmichVersion)
+	}
+	ic.version = &version
+	return version, nil
+}
+
+// Récupérer la liste des albums partagés
+func (ic *ImmichClient) FetchAlbums() ([]Album, error) {
+	var albums []Album
+	err := ic.call(http.MethodGet, "/albums", url.Values{"shared": {"true"}}, nil, &albums)
+	return albums, err
+}
+
+// Récupérer la liste de tous les albums de l'utilisateur, partagés ou non
+func (ic *ImmichClient) FetchAllAlbums() ([]Album, error) {
+	var albums []Album
+	err := ic.call(http.MethodGet, "/albums", nil, nil, &albums)
+	return albums, err
+}
+
+// Obtenir la clé de partage pour un album : un lien existant encore valide pendant au moins la durée des liens de policy,
+// sinon un nouveau lien créé selon policy.
+// created indique si le lien vient d'être créé.
+func (ic *ImmichClient) GetSharingKey(album Album, policy *LinkPolicy) (key Key, created bool, err error) {
+	if album.HasSharedLink {
+		// Récupérer la clé existante
+		var keys []Key
+		if err := ic.call(http.MethodGet, "/shared-links", nil, nil, &keys); err != nil {
+			return Key{}, false, err
+		}
+		for _, key := range keys {
+			if key.Album != nil && key.Album.ID == album.ID && !key.Expired(policy.validUntil(time.Now())) {
+				return key, false, nil
+			}
+		}
+	}
+
+	// Créer un nouveau lien partagé
+	key, err = ic.createSharedLink(policy.request(map[string]interface{}{
+		"type":    "ALBUM",
+		"albumId": album.ID,
+	}))
+	return key, err == nil, err
+}
+
+// Créer un lien partagé à partir du corps de la requête
+func (ic *ImmichClient) createSharedLink(request map[string]interface{}) (Key, error) {
+	var key Key
+	err := ic.call(http.MethodPost, "/shared-links", nil, request, &key)
+	return key, err
+}
+
+// Créer un lien partagé vers une liste de photos, selon policy
+func (ic *ImmichClient) CreateAssetsSharingKey(assetIDs []string, description string, policy *LinkPolicy) (Key, error) {
+	return ic.createSharedLink(policy.request(map[string]interface{}{
+		"type":        "INDIVIDUAL",
+		"assetIds":    assetIDs,
+		"description": description,
+	}))
+}
+
+// Supprimer un lien partagé, sans erreur s'il n'existe plus
+func (ic *ImmichClient) DeleteSharedLink(id string) error {
+	err := ic.call(http.MethodDelete, "/shared-links/"+url.PathEscape(id), nil, nil, nil)
+	if isImmichStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Récupérer la liste des tags
+func (ic *ImmichClient) FetchTags() ([]Tag, error) {
+	var tags []Tag
+	err := ic.call(http.MethodGet, "/tags", nil, nil, &tags)
+	return tags, err
+}
+
+// Récupérer les photos d'un album
+func (ic *ImmichClient) FetchAlbumAssets(albumID string) ([]Asset, error) {
+	var album struct {
+		Assets []Asset `json:"assets"`
+	}
+	err := ic.call(http.MethodGet, "/albums/"+url.PathEscape(albumID), nil, nil, &album)
+	return album.Assets, err
+}
+
+// Récupérer la photo la plus ancienne d'un album, found vaut false si l'album est vide
+func (ic *ImmichClient) FetchEarliestAlbumAsset(albumID string) (asset Asset, found bool, err error) {
+	var result struct {
+		Assets struct {
+			Items []Asset `json:"items"`
+		} `json:"assets"`
+	}
+	err = ic.call(http.MethodPost, "/search/metadata", nil, map[string]interface{}{
+		"albumIds": []string{albumID},
+		"order":    "asc",
+		"size":     1,
+	}, &result)
+	if err != nil || len(result.Assets.Items) == 0 {
+		return Asset{}, false, err
+	}
+	return result.Assets.Items[0], true, nil
+}
+
+// Vérifier si un album contient au moins une photo avec le tag
+func (ic *ImmichClient) AlbumHasTag(albumID string, tagID string) (bool, error) {
+	var result struct {
+		Assets struct {
+			Count int `json:"count"`
+		} `json:"assets"`
+	}
+	err := ic.call(http.MethodPost, "/search/metadata", nil, map[string]interface{}{
+		"albumIds": []string{albumID},
+		"tagIds":   []string{tagID},
+		"size":     1,
+	}, &result)
+	return result.Assets.Count > 0, err
+}
+
+// Rechercher les photos prises entre deux dates, page par page, sans les vidéos
+func (ic *ImmichClient) SearchAssetsByDate(after time.Time, before time.Time) ([]Asset, error) {
+	var assets []Asset
+	for page := 1; page > 0; {
+		var result struct {
+			Assets struct {
+				Items    []Asset `json:"items"`
+				NextPage *string `json:"nextPage"`
+			} `json:"assets"`
+		}
+		err := ic.call(http.MethodPost, "/search/metadata", nil, map[string]interface{}{
+			"takenAfter":  after,
+			"takenBefore": before,
+			"type":        "IMAGE",
+			"page":        page,
+			"size":        1000,
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, result.Assets.Items...)
+
+		page = 0
+		if result.Assets.NextPage != nil {
+			page, _ = strconv.Atoi(*result.Assets.NextPage)
+		}
+	}
+	return assets, nil
+}
+
+// Tailles des miniatures fournies par Immich
+const (
+	SizeThumbnail = "thumbnail" // 250 pixels
+	SizePreview   = "preview"   // 1440 pixels
+)
+
+// Récupérer la miniature d'une photo à la taille size
+func (ic *ImmichClient) GetThumbnail(assetID string, size string) ([]byte, error) {
+	res, err := ic.request(http.MethodGet, "/assets/"+url.PathEscape(assetID)+"/thumbnail", url.Values{"size": {size}}, nil, "application/octet-stream")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// Les types de messages envoyés
+const (
+	KindAnniversary = "anniversary"
+	KindNewAlbum    = "new-album"
+	KindOnThisDay   = "on-this-day"
+	KindDigest      = "digest"
+)
+
+// Registre des messages envoyés, pour ne pas les envoyer à nouveau lors d'une nouvelle tentative ou d'un redémarrage
+type Ledger struct {
+	db       *sql.DB
+	Replay   bool // Envoyer à nouveau les messages déjà envoyés, sans les enregistrer
+	ReadOnly bool // Consulter le registre sans y enregistrer les envois, pour --dry-run
+}
+
+// Fonction pour obtenir le chemin du registre : LEDGER-FILE, ou ledger.db à côté de la session WhatsApp
+func ledgerFile(param *Parameters) string {
+	if param.LedgerFile != "" {
+		return param.LedgerFile
+	}
+	if param.WhatsappSessionFile != "" {
+		return filepath.Join(filepath.Dir(param.WhatsappSessionFile), "ledger.db")
+	}
+	return "ledger.db"
+}
+
+// Fonction pour ouvrir le registre, en le créant si nécessaire
+func OpenLedger(file string) (*Ledger, error) {
+	db, err := sql.Open("sqlite3", "file:"+file+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sent (
+		album_id TEXT NOT NULL,
+		album_name TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		date TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		sent_at TEXT NOT NULL,
+		PRIMARY KEY (album_id, kind, date, destination)
+	);
+	CREATE TABLE IF NOT EXISTS links (
+		id TEXT PRIMARY KEY,
+		key TEXT NOT NULL,
+		album_id TEXT NOT NULL,
+		album_name TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		expires_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating ledger '%s': %v", file, err)
+	}
+	return &Ledger{db: db}, nil
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// Méthode pour obtenir les destinations auxquelles le message n'a pas encore été envoyé, toutes si le registre est nil ou en mode Replay
+func (l *Ledger) Pending(album Album, kind string, date time.Time, destinations []Destination) ([]Destination, error) {
+	if l == nil || l.Replay {
+		return destinations, nil
+	}
+	var pending []Destination
+	for _, destination := range destinations {
+		var count int
+		err := l.db.QueryRow(`SELECT COUNT(*) FROM sent WHERE album_id = ? AND kind = ? AND date = ? AND destination = ?`,
+			album.ID, kind, date.Format(time.DateOnly), destination.Name).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			pending = append(pending, destination)
+		}
+	}
+	return pending, nil
+}
+
+// Méthode pour enregistrer l'envoi d'un message, sans effet si le registre est nil, en mode Replay ou ReadOnly
+func (l *Ledger) Record(album Album, kind string, date time.Time, destination Destination) error {
+	if l == nil || l.Replay || l.ReadOnly {
+		return nil
+	}
+	_, err := l.db.Exec(`INSERT OR IGNORE INTO sent (album_id, album_name, kind, date, destination, sent_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		album.ID, album.Name, kind, date.Format(time.DateOnly), destination.Name, time.Now().Format(time.RFC3339))
+	return err
+}
+
+// Lien partagé créé par l'outil
+type LinkRecord struct {
+	ID        string
+	Key       string
+	AlbumID   string
+	AlbumName string
+	CreatedAt time.Time
+	ExpiresAt time.Time // Zéro si le lien n'expire pas
+}
+
+// Méthode pour enregistrer un lien partagé créé par l'outil, sans effet si le registre est nil
+func (l *Ledger) RecordLink(key Key, album Album) error {
+	if l == nil {
+		return nil
+	}
+	expiresAt := ""
+	if key.ExpiresAt != nil {
+		expiresAt = key.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	_, err := l.db.Exec(`INSERT OR REPLACE INTO links (id, key, album_id, album_name, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		key.ID, key.Key, album.ID, album.Name, time.Now().UTC().Format(time.RFC3339), expiresAt)
+	return err
+}
+
+// Méthode pour obtenir les liens partagés créés par l'outil, seulement ceux expirés à la date now si expiredOnly
+func (l *Ledger) Links(expiredOnly bool, now time.Time) ([]LinkRecord, error) {
+	query := `SELECT id, key, album_id, album_name, created_at, expires_at FROM links`
+	var args []interface{}
+	if expiredOnly {
+		query += ` WHERE expires_at != '' AND expires_at <= ?`
+		args = append(args, now.UTC().Format(time.RFC3339))
+	}
+	rows, err := l.db.Query(query+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []LinkRecord
+	for rows.Next() {
+		var link LinkRecord
+		var createdAt, expiresAt string
+		if err := rows.Scan(&link.ID, &link.Key, &link.AlbumID, &link.AlbumName, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		link.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		if expiresAt != "" {
+			link.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// Méthode pour obtenir le dernier lien partagé créé par l'outil pour un album depuis la date createdSince et encore valide à la date validUntil
+func (l *Ledger) LinkFor(albumID string, createdSince time.Time, validUntil time.Time) (LinkRecord, bool, error) {
+	if l == nil {
+		return LinkRecord{}, false, nil
+	}
+	var link LinkRecord
+	var createdAt, expiresAt string
+	err := l.db.QueryRow(`SELECT id, key, album_id, album_name, created_at, expires_at FROM links WHERE album_id = ? AND created_at >= ? AND (expires_at = '' OR expires_at > ?) ORDER BY created_at DESC LIMIT 1`,
+		albumID, createdSince.UTC().Format(time.RFC3339), validUntil.UTC().Format(time.RFC3339)).Scan(&link.ID, &link.Key, &link.AlbumID, &link.AlbumName, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return LinkRecord{}, false, nil
+	}
+	if err != nil {
+		return LinkRecord{}, false, err
+	}
+	link.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	if expiresAt != "" {
+		link.ExpiresAt, _ = time.Parse(time.RFC3339, expiresAt)
+	}
+	return link, true, nil
+}
+
+// Méthode pour oublier un lien partagé révoqué
+func (l *Ledger) ForgetLink(id string) error {
+	_, err := l.db.Exec(`DELETE FROM links WHERE id = ?`, id)
+	return err
+}
+
+// Méthode pour afficher les messages envoyés depuis une date
+func (l *Ledger) Print(w io.Writer, since time.Time) error {
+	rows, err := l.db.Query(`SELECT date, kind, destination, album_name, album_id, sent_at FROM sent WHERE date >= ? ORDER BY date, sent_at`, since.Format(time.DateOnly))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tKIND\tDESTINATION\tALBUM\tALBUM ID\tSENT AT")
+	for rows.Next() {
+		var date, kind, destination, albumName, albumID, sentAt string
+		if err := rows.Scan(&date, &kind, &destination, &albumName, &albumID, &sentAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", date, kind, destination, albumName, albumID, sentAt)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// Fonction pour la commande "ledger" qui affiche le registre
+func ledgerCommand(param *Parameters, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("ledger", flag.ContinueOnError)
+	days := flags.Int("days", 30, "Show the messages sent during the last days, 0 to show all of them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ledger, err := OpenLedger(ledgerFile(param))
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	var since time.Time
+	if *days > 0 {
+		since = time.Now().AddDate(0, 0, -*days)
+	}
+	return ledger.Print(w, since)
+}
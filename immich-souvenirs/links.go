@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Paramètres des liens partagés créés par l'outil
+type LinkPolicy struct {
+	AllowDownload bool
+	AllowUpload   bool
+	ShowMetadata  bool
+	Password      string
+	ExpiryDays    int // 0 si les liens n'expirent pas
+}
+
+// Fonction pour lire les paramètres des liens partagés :
+//   - LINK-ALLOW-DOWNLOAD, autoriser le téléchargement (true par défaut)
+//   - LINK-ALLOW-UPLOAD, autoriser l'ajout de photos (false par défaut)
+//   - LINK-SHOW-METADATA, afficher les métadonnées (true par défaut)
+//   - LINK-PASSWORD, mot de passe des liens
+//   - LINK-EXPIRY-DAYS, nombre de jours après lesquels les liens expirent et sont révoqués
+func loadLinkPolicy(param *Parameters) (*LinkPolicy, error) {
+	policy := &LinkPolicy{Password: param.LinkPassword}
+	options := []struct {
+		name         string
+		value        string
+		defaultValue bool
+		field        *bool
+	}{
+		{"LINK-ALLOW-DOWNLOAD", param.LinkAllowDownload, true, &policy.AllowDownload},
+		{"LINK-ALLOW-UPLOAD", param.LinkAllowUpload, false, &policy.AllowUpload},
+		{"LINK-SHOW-METADATA", param.LinkShowMetadata, true, &policy.ShowMetadata},
+	}
+	for _, option := range options {
+		*option.field = option.defaultValue
+		if option.value != "" {
+			value, err := strconv.ParseBool(option.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s '%s', it must be true or false", option.name, option.value)
+			}
+			*option.field = value
+		}
+	}
+	if param.LinkExpiryDays != "" {
+		days, err := strconv.Atoi(param.LinkExpiryDays)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid LINK-EXPIRY-DAYS '%s'", param.LinkExpiryDays)
+		}
+		policy.ExpiryDays = days
+	}
+	return policy, nil
+}
+
+// Méthode pour compléter la requête de création d'un lien partagé avec les paramètres
+func (p *LinkPolicy) request(request map[string]interface{}) map[string]interface{} {
+	request["allowDownload"] = p.AllowDownload
+	request["allowUpload"] = p.AllowUpload
+	request["showMetadata"] = p.ShowMetadata
+	if p.Password != "" {
+		request["password"] = p.Password
+	}
+	if p.ExpiryDays > 0 {
+		request["expiresAt"] = time.Now().AddDate(0, 0, p.ExpiryDays).UTC().Format(time.RFC3339)
+	}
+	return request
+}
+
+// Méthode pour obtenir la date jusqu'à laquelle un lien existant doit rester valide pour être réutilisé :
+// un lien réutilisé doit rester valide au moins aussi longtemps qu'un nouveau lien
+func (p *LinkPolicy) validUntil(now time.Time) time.Time {
+	return now.AddDate(0, 0, p.ExpiryDays)
+}
+
+// Fonction pour obtenir le lien de partage d'un album, en enregistrant les liens créés.
+// Aucun lien n'est créé avec --dry-run.
+func albumLink(immichClient *ImmichClient, ledger *Ledger, param *Parameters, album Album) (string, error) {
+	if param.DryRun {
+		return placeholderLink(param), nil
+	}
+	key, created, err := immichClient.GetSharingKey(album, param.LinkPolicy)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		if err := ledger.RecordLink(key, album); err != nil {
+			fmt.Fprintf(os.Stderr, "erreur registre: %v\n", err)
+		}
+	}
+	return param.ImmichURL + "/share/" + key.Key, nil
+}
+
+// Fonction pour obtenir le lien de partage d'une liste de photos : le lien déjà enregistré pour l'album aujourd'hui s'il est encore valide,
+// sinon un nouveau lien qui est enregistré. L'identifiant de l'album revient chaque année avec d'autres photos,
+// un lien d'un autre jour n'est donc pas réutilisé. Aucun lien n'est créé avec --dry-run.
+func assetsLink(immichClient *ImmichClient, ledger *Ledger, param *Parameters, assetIDs []string, album Album) (string, error) {
+	if param.DryRun {
+		return placeholderLink(param), nil
+	}
+	now := time.Now()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	link, found, err := ledger.LinkFor(album.ID, startOfDay, param.LinkPolicy.validUntil(now))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erreur registre: %v\n", err)
+	} else if found {
+		return param.ImmichURL + "/share/" + link.Key, nil
+	}
+	key, err := immichClient.CreateAssetsSharingKey(assetIDs, album.Name, param.LinkPolicy)
+	if err != nil {
+		return "", err
+	}
+	if err := ledger.RecordLink(key, album); err != nil {
+		fmt.Fprintf(os.Stderr, "erreur registre: %v\n", err)
+	}
+	return param.ImmichURL + "/share/" + key.Key, nil
+}
+
+// Fonction pour révoquer des liens partagés et les oublier, renvoie le nombre de liens révoqués
+func revokeLinks(immichClient *ImmichClient, ledger *Ledger, links []LinkRecord, w io.Writer) int {
+	revoked := 0
+	for _, link := range links {
+		if err := immichClient.DeleteSharedLink(link.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "erreur révocation lien '%s' (%s): %v\n", link.Key, link.AlbumName, err)
+			continue
+		}
+		if err := ledger.ForgetLink(link.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "erreur registre: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(w, "Lien '%s' (%s) révoqué\n", link.Key, link.AlbumName)
+		revoked++
+	}
+	return revoked
+}
+
+// Fonction pour révoquer les liens partagés créés par l'outil qui ont expiré, les erreurs sont seulement affichées
+func revokeExpiredLinks(immichClient *ImmichClient, ledger *Ledger, now time.Time) {
+	links, err := ledger.Links(true, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "erreur registre: %v\n", err)
+		return
+	}
+	revokeLinks(immichClient, ledger, links, os.Stdout)
+}
+
+// Fonction pour la commande "cleanup-links" qui révoque les liens partagés expirés, ou tous ceux créés par l'outil avec -all
+func cleanupLinksCommand(param *Parameters, immichClient *ImmichClient, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("cleanup-links", flag.ContinueOnError)
+	all := flags.Bool("all", false, "Revoke all the shared links created by the tool, not only the expired ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ledger, err := OpenLedger(ledgerFile(param))
+	if err != nil {
+		return err
+	}
+	defer ledger.Close()
+
+	links, err := ledger.Links(!*all, time.Now())
+	if err != nil {
+		return err
+	}
+	if revoked := revokeLinks(immichClient, ledger, links, w); revoked < len(links) {
+		return fmt.Errorf("%d link(s) not revoked", len(links)-revoked)
+	}
+	return nil
+}
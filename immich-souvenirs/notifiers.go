@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message à envoyer pour un album
+type Message struct {
+	Title       string
+	Description string
+	Text        string // Le texte complet, qui contient le lien
+	URL         string
+	Thumbnail   []byte  // Miniature au format JPEG, éventuellement vide
+	Photos      []Photo // Photos à envoyer à la place de la miniature, seulement par WhatsApp
+}
+
+// Un Notifier envoie les messages vers un canal, la cible (groupe, salon, destinataires...) dépend du canal
+type Notifier interface {
+	Send(target string, msg Message) error
+}
+
+// Un Connector est un Notifier qui doit être connecté avant l'envoi des messages
+type Connector interface {
+	Connect() error
+	Disconnect()
+}
+
+// Un PhotoNotifier est un Notifier qui peut envoyer les photos des messages, les autres canaux les ignorent
+type PhotoNotifier interface {
+	SendsPhotos() bool
+}
+
+// Fonction pour vérifier si au moins une des destinations envoie les photos des messages
+func sendsPhotos(destinations []Destination) bool {
+	for _, destination := range destinations {
+		if notifier, ok := destination.Notifier.(PhotoNotifier); ok && notifier.SendsPhotos() {
+			return true
+		}
+	}
+	return false
+}
+
+// Destination des messages : un canal et sa cible
+type Destination struct {
+	Name     string
+	Notifier Notifier
+	Target   string
+}
+
+// Client HTTP partagé par les canaux
+var notifierClient = &http.Client{Timeout: 30 * time.Second}
+
+// Fonction pour créer un canal à partir de son nom, elle renvoie aussi la cible par défaut.
+// Avec --dry-run, WhatsApp n'est pas connecté : son canal est remplacé ensuite par Router.DryRun.
+func newNotifier(name string, param *Parameters) (Notifier, string, error) {
+	switch name {
+	case "whatsapp":
+		if param.DryRun {
+			return &DryRunNotifier{Name: name, Writer: io.Discard, Photos: true}, param.WhatsappGroup, nil
+		}
+		wac, err := NewWhatsAppClient(param.WhatsappSessionFile)
+		if err != nil {
+			return nil, "", err
+		}
+		return wac, param.WhatsappGroup, nil
+	case "telegram":
+		if param.TelegramToken == "" {
+			return nil, "", fmt.Errorf("TELEGRAM-TOKEN is required")
+		}
+		return &TelegramNotifier{Token: param.TelegramToken}, param.TelegramChatID, nil
+	case "matrix":
+		if param.MatrixURL == "" || param.MatrixToken == "" {
+			return nil, "", fmt.Errorf("MATRIX-URL and MATRIX-TOKEN are required")
+		}
+		return &MatrixNotifier{BaseURL: strings.TrimSuffix(param.MatrixURL, "/"), Token: param.MatrixToken}, param.MatrixRoom, nil
+	case "signal":
+		if param.SignalURL == "" || param.SignalNumber == "" {
+			return nil, "", fmt.Errorf("SIGNAL-URL and SIGNAL-NUMBER are required")
+		}
+		return &SignalNotifier{BaseURL: strings.TrimSuffix(param.SignalURL, "/"), Number: param.SignalNumber}, param.SignalRecipients, nil
+	case "discord":
+		return &DiscordNotifier{}, param.DiscordWebhook, nil
+	case "slack":
+		return &SlackNotifier{}, param.SlackWebhook, nil
+	case "ntfy":
+		if param.NtfyURL == "" {
+			return nil, "", fmt.Errorf("NTFY-URL is required")
+		}
+		return &NtfyNotifier{BaseURL: strings.TrimSuffix(param.NtfyURL, "/"), Token: param.NtfyToken}, param.NtfyTopic, nil
+	case "email":
+		if param.SMTPServer == "" || param.SMTPFrom == "" {
+			return nil, "", fmt.Errorf("SMTP-SERVER and SMTP-FROM are required")
+		}
+		return &EmailNotifier{Server: param.SMTPServer, Username: param.SMTPUsername, Password: param.SMTPPassword, From: param.SMTPFrom}, param.SMTPTo, nil
+	default:
+		return nil, "", fmt.Errorf("unknown notifier")
+	}
+}
+
+// Fonction pour connecter les canaux qui le nécessitent, elle renvoie la fonction pour les déconnecter
+func connectDestinations(destinations []Destination) (func(), error) {
+	var connected []Connector
+	disconnect := func() {
+		for _, connector := range connected {
+			connector.Disconnect()
+		}
+	}
+	for _, destination := range destinations {
+		connector, ok := destination.Notifier.(Connector)
+		if !ok {
+			continue
+		}
+		if err := connector.Connect(); err != nil {
+			disconnect()
+			return nil, fmt.Errorf("%s: %v", destination.Name, err)
+		}
+		connected = append(connected, connector)
+	}
+	return disconnect, nil
+}
+
+// Fonction pour envoyer un message à toutes les destinations, elle renvoie celles auxquelles il a été envoyé
+func notify(destinations []Destination, msg Message) []Destination {
+	var sent []Destination
+	for _, destination := range destinations {
+		if err := destination.Notifier.Send(destination.Target, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "erreur envoi %s: %v\n", destination.Name, err)
+			continue
+		}
+		sent = append(sent, destination)
+	}
+	return sent
+}
+
+// Fonction pour exécuter une requête HTTP et décoder la réponse JSON dans result (si non nil)
+func doRequest(req *http.Request, result interface{}) error {
+	res, err := notifierClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		if len(body) > 512 {
+			body = body[:512]
+		}
+		return fmt.Errorf("status code %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fonction pour créer une requête HTTP avec un corps JSON
+func newJSONRequest(method string, url string, payload interface{}) (*http.Request, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Fonction pour formater le message en HTML, avec le lien cliquable
+func htmlText(msg Message, lineBreak string) string {
+	text := html.EscapeString(msg.Text)
+	if msg.URL != "" {
+		link := html.EscapeString(msg.URL)
+		text = strings.Replace(text, link, `<a href="`+link+`">`+link+`</a>`, 1)
+	}
+	result := "<b>" + html.EscapeString(msg.Title) + "</b>" + lineBreak
+	if msg.Description != "" {
+		result += "<i>" + html.EscapeString(msg.Description) + "</i>" + lineBreak
+	}
+	return result + text
+}
+
+// Fonction pour formater le message en texte simple
+func plainText(msg Message) string {
+	result := msg.Title + "\n"
+	if msg.Description != "" {
+		result += msg.Description + "\n"
+	}
+	return result + msg.Text
+}
+
+// Envoi par un bot Telegram : la miniature en photo, avec le message en légende
+type TelegramNotifier struct {
+	Token string
+}
+
+func (tn *TelegramNotifier) Send(chatID string, msg Message) error {
+	req, err := tn.newRequest(chatID, msg)
+	if err != nil {
+		return err
+	}
+	// Telegram renvoie la description de l'erreur dans le corps, le jeton qui est dans l'URL est masqué
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending Telegram message with title '%s': %s", msg.Title, strings.ReplaceAll(err.Error(), tn.Token, "***"))
+	}
+	return nil
+}
+
+func (tn *TelegramNotifier) newRequest(chatID string, msg Message) (*http.Request, error) {
+	apiURL := "https://api.telegram.org/bot" + tn.Token
+	if len(msg.Thumbnail) == 0 {
+		return newJSONRequest(http.MethodPost, apiURL+"/sendMessage", map[string]string{
+			"chat_id":    chatID,
+			"text":       htmlText(msg, "\n"),
+			"parse_mode": "HTML",
+		})
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("chat_id", chatID)
+	writer.WriteField("caption", htmlText(msg, "\n"))
+	writer.WriteField("parse_mode", "HTML")
+	part, err := writer.CreateFormFile("photo", "thumbnail.jpg")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(msg.Thumbnail)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL+"/sendPhoto", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
+// Envoi dans un salon Matrix : la miniature en image, puis le message en HTML
+type MatrixNotifier struct {
+	BaseURL string
+	Token   string
+}
+
+func (mn *MatrixNotifier) Send(room string, msg Message) error {
+	if len(msg.Thumbnail) > 0 {
+		req, err := http.NewRequest(http.MethodPost, mn.BaseURL+"/_matrix/media/v3/upload?filename=thumbnail.jpg", bytes.NewReader(msg.Thumbnail))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+mn.Token)
+		req.Header.Set("Content-Type", "image/jpeg")
+		var upload struct {
+			ContentURI string `json:"content_uri"`
+		}
+		if err := doRequest(req, &upload); err != nil {
+			return fmt.Errorf("error uploading Matrix thumbnail: %v", err)
+		}
+		if err := mn.sendEvent(room, map[string]interface{}{
+			"msgtype": "m.image",
+			"body":    msg.Title,
+			"url":     upload.ContentURI,
+			"info":    map[string]interface{}{"mimetype": "image/jpeg", "size": len(msg.Thumbnail)},
+		}); err != nil {
+			return err
+		}
+	}
+	return mn.sendEvent(room, map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           plainText(msg),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": htmlText(msg, "<br>"),
+	})
+}
+
+func (mn *MatrixNotifier) sendEvent(room string, content map[string]interface{}) error {
+	txnID := fmt.Sprintf("immich-souvenirs-%d", time.Now().UnixNano())
+	req, err := newJSONRequest(http.MethodPut, mn.BaseURL+"/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/send/m.room.message/"+txnID, content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+mn.Token)
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending Matrix message to '%s': %v", room, err)
+	}
+	return nil
+}
+
+// Envoi par l'API REST de signal-cli : le message avec un aperçu du lien
+type SignalNotifier struct {
+	BaseURL string
+	Number  string
+}
+
+func (sn *SignalNotifier) Send(recipients string, msg Message) error {
+	payload := map[string]interface{}{
+		"number":     sn.Number,
+		"recipients": splitList(recipients),
+		"message":    plainText(msg),
+	}
+	if msg.URL != "" {
+		preview := map[string]string{"url": msg.URL, "title": msg.Title, "description": msg.Description}
+		if len(msg.Thumbnail) > 0 {
+			preview["base64_thumbnail"] = base64.StdEncoding.EncodeToString(msg.Thumbnail)
+		}
+		payload["link_preview"] = preview
+	} else if len(msg.Thumbnail) > 0 {
+		payload["base64_attachments"] = []string{"data:image/jpeg;filename=thumbnail.jpg;base64," + base64.StdEncoding.EncodeToString(msg.Thumbnail)}
+	}
+	req, err := newJSONRequest(http.MethodPost, sn.BaseURL+"/v2/send", payload)
+	if err != nil {
+		return err
+	}
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending Signal message with title '%s': %v", msg.Title, err)
+	}
+	return nil
+}
+
+// Envoi par un webhook Discord : un embed avec le titre, la description et la miniature jointe
+type DiscordNotifier struct{}
+
+func (dn *DiscordNotifier) Send(webhook string, msg Message) error {
+	embed := map[string]interface{}{
+		"title":       msg.Title,
+		"description": msg.Description,
+		"url":         msg.URL,
+	}
+	payload := map[string]interface{}{
+		"content": msg.Text,
+		"embeds":  []interface{}{embed},
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if len(msg.Thumbnail) > 0 {
+		embed["image"] = map[string]string{"url": "attachment://thumbnail.jpg"}
+		payload["attachments"] = []interface{}{map[string]interface{}{"id": 0, "filename": "thumbnail.jpg"}}
+		part, err := writer.CreateFormFile("files[0]", "thumbnail.jpg")
+		if err != nil {
+			return err
+		}
+		part.Write(msg.Thumbnail)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	writer.WriteField("payload_json", string(data))
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending Discord message with title '%s': %v", msg.Title, err)
+	}
+	return nil
+}
+
+// Envoi par un webhook Slack : les webhooks ne permettent pas de joindre d'image, Slack affiche l'aperçu du lien à la place
+type SlackNotifier struct{}
+
+func (sn *SlackNotifier) Send(webhook string, msg Message) error {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	text := "*" + escape.Replace(msg.Title) + "*"
+	if msg.URL != "" {
+		text = "*<" + msg.URL + "|" + escape.Replace(msg.Title) + ">*"
+	}
+	if msg.Description != "" {
+		text += "\n" + escape.Replace(msg.Description)
+	}
+	text += "\n" + escape.Replace(msg.Text)
+	req, err := newJSONRequest(http.MethodPost, webhook, map[string]interface{}{
+		"text":         plainText(msg),
+		"unfurl_links": true,
+		"blocks": []interface{}{map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending Slack message with title '%s': %v", msg.Title, err)
+	}
+	return nil
+}
+
+// Envoi par ntfy : une notification avec la miniature en pièce jointe, qui ouvre le lien
+type NtfyNotifier struct {
+	BaseURL string
+	Token   string
+}
+
+func (nn *NtfyNotifier) Send(topic string, msg Message) error {
+	var req *http.Request
+	var err error
+	if len(msg.Thumbnail) > 0 {
+		req, err = http.NewRequest(http.MethodPut, nn.BaseURL+"/"+url.PathEscape(topic), bytes.NewReader(msg.Thumbnail))
+		if err == nil {
+			req.Header.Set("Filename", "thumbnail.jpg")
+			// Les entêtes ne peuvent contenir de retour à la ligne
+			req.Header.Set("Message", mime.BEncoding.Encode("UTF-8", strings.ReplaceAll(msg.Text, "\n", " ")))
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodPost, nn.BaseURL+"/"+url.PathEscape(topic), strings.NewReader(msg.Text))
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", mime.BEncoding.Encode("UTF-8", msg.Title))
+	if msg.URL != "" {
+		req.Header.Set("Click", msg.URL)
+	}
+	if nn.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+nn.Token)
+	}
+	if err := doRequest(req, nil); err != nil {
+		return fmt.Errorf("error sending ntfy message with title '%s': %v", msg.Title, err)
+	}
+	return nil
+}
+
+// Envoi par email : un message HTML avec la miniature intégrée
+type EmailNotifier struct {
+	Server   string // hôte:port
+	Username string
+	Password string
+	From     string
+}
+
+func (en *EmailNotifier) Send(to string, msg Message) error {
+	recipients := splitList(to)
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipient")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fmt.Fprintf(&body, "From: %s\r\n", en.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", msg.Title))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: multipart/related; boundary=%s\r\n\r\n", writer.Boundary())
+
+	content := htmlText(msg, "<br>")
+	if len(msg.Thumbnail) > 0 {
+		image := `<img src="cid:thumbnail" alt="` + html.EscapeString(msg.Title) + `">`
+		if msg.URL != "" {
+			image = `<a href="` + html.EscapeString(msg.URL) + `">` + image + `</a>`
+		}
+		content += "<br>" + image
+	}
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte("<html><body>" + content + "</body></html>"))
+	qp.Close()
+
+	if len(msg.Thumbnail) > 0 {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<thumbnail>"},
+			"Content-Disposition":       {`inline; filename="thumbnail.jpg"`},
+		})
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString(msg.Thumbnail)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if en.Username != "" {
+		host, _, err := net.SplitHostPort(en.Server)
+		if err != nil {
+			return fmt.Errorf("incorrect SMTP server '%s': %v", en.Server, err)
+		}
+		auth = smtp.PlainAuth("", en.Username, en.Password, host)
+	}
+	if err := smtp.SendMail(en.Server, auth, en.From, recipients, body.Bytes()); err != nil {
+		return fmt.Errorf("error sending email with title '%s': %v", msg.Title, err)
+	}
+	return nil
+}
+
+// Fonction pour découper une liste séparée par des virgules
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
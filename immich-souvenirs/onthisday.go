@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Nombre d'années passées dans lesquelles chercher les photos prises ce jour-là, par défaut
+const defaultOnThisDayYears = 30
+
+// Photos prises ce jour-là une année passée, avec un album fictif pour le routage et le registre
+type onThisDay struct {
+	Album  Album
+	Data   TemplateData
+	Assets []Asset
+}
+
+// Fonction pour rechercher, pour chaque année passée, les photos prises ce jour-là, sauf celles des albums masqués ou exclus par FILTERS-FILE.
+// Les erreurs sont passées à fail et n'interrompent pas la recherche des autres années.
+func findOnThisDay(immichClient *ImmichClient, param *Parameters, today time.Time, fail func(error)) []onThisDay {
+	years := defaultOnThisDayYears
+	if param.OnThisDayYears != "" {
+		var err error
+		years, err = strconv.Atoi(param.OnThisDayYears)
+		if err != nil || years < 1 {
+			fail(fmt.Errorf("ON-THIS-DAY-YEARS invalide: %s", param.OnThisDayYears))
+			return nil
+		}
+	}
+
+	var found []onThisDay
+	var hidden map[string]bool
+	for yearsAgo := 1; yearsAgo <= years; yearsAgo++ {
+		day := time.Date(today.Year()-yearsAgo, today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+		if day.Day() != today.Day() {
+			// Le 29 février n'existe pas cette année-là
+			continue
+		}
+		assets, err := immichClient.SearchAssetsByDate(day, day.AddDate(0, 0, 1))
+		if err != nil {
+			fail(fmt.Errorf("erreur recherche photos du %s: %v", day.Format(time.DateOnly), err))
+			continue
+		}
+		if len(assets) > 0 && hidden == nil {
+			// Sans la liste des photos masquées, aucune photo n'est envoyée
+			if hidden, err = hiddenAssets(immichClient, param.Filter); err != nil {
+				fail(fmt.Errorf("erreur recherche photos des albums masqués: %v", err))
+				return nil
+			}
+		}
+		var visible []Asset
+		for _, asset := range assets {
+			if !hidden[asset.ID] {
+				visible = append(visible, asset)
+			}
+		}
+		assets = visible
+		if len(assets) == 0 {
+			continue
+		}
+
+		data := TemplateData{YearsAgo: yearsAgo, AssetCount: len(assets), StartDate: day, EndDate: day, Date: day}
+		title, err := param.Templates.Render("on-this-day-title", data)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		album := Album{
+			ID:        "on-this-day-" + day.Format(time.DateOnly),
+			Name:      title,
+			StartDate: day,
+		}
+		found = append(found, onThisDay{Album: album, Data: data, Assets: assets})
+	}
+	return found
+}
+
+// Fonction pour obtenir les identifiants des photos des albums masqués ou exclus par le filtre
+func hiddenAssets(immichClient *ImmichClient, filter *AlbumFilter) (map[string]bool, error) {
+	albums, err := immichClient.FetchAllAlbums()
+	if err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool)
+	for _, album := range albums {
+		if !filter.Hides(album) {
+			continue
+		}
+		assets, err := immichClient.FetchAlbumAssets(album.ID)
+		if err != nil {
+			return nil, fmt.Errorf("album '%s': %v", album.Name, err)
+		}
+		for _, asset := range assets {
+			hidden[asset.ID] = true
+		}
+	}
+	return hidden, nil
+}
+
+// Fonction pour envoyer, pour chaque année passée, les photos prises ce jour-là avec un lien partagé créé pour l'occasion.
+// Les envois et les erreurs sont comptés dans summary.
+func sendOnThisDay(router *Router, immichClient *ImmichClient, ledger *Ledger, summary *RunSummary, param *Parameters, today time.Time) {
+	for _, day := range findOnThisDay(immichClient, param, today, summary.Fail) {
+		err := send(router, immichClient, ledger, summary, day.Album, KindOnThisDay, today, func(destinations []Destination) (Message, error) {
+			var assetIDs []string
+			for _, asset := range day.Assets {
+				assetIDs = append(assetIDs, asset.ID)
+			}
+			link, err := assetsLink(immichClient, ledger, param, assetIDs, day.Album)
+			if err != nil {
+				return Message{}, fmt.Errorf("erreur création lien partagé: %v", err)
+			}
+			return onThisDayMessage(immichClient, param, day, link, sendsPhotos(destinations))
+		})
+		if err != nil {
+			summary.Fail(err)
+		}
+	}
+}
+
+// Fonction pour construire le message des photos d'un jour passé, avec les photos à envoyer si withPhotos
+func onThisDayMessage(immichClient *ImmichClient, param *Parameters, day onThisDay, link string, withPhotos bool) (Message, error) {
+	data := day.Data
+	data.Link = link
+
+	thumbnail, err := assetsThumbnail(immichClient, param, day.Assets)
+	if err != nil {
+		return Message{}, fmt.Errorf("erreur miniature: %v", err)
+	}
+
+	var photos []Photo
+	if count, _ := photoCount(param); count > 0 && withPhotos {
+		photos, err = fetchPhotos(immichClient, param, day.Assets, count)
+		if err != nil {
+			return Message{}, fmt.Errorf("erreur récupération photos: %v", err)
+		}
+	}
+
+	description, err := param.Templates.Render("on-this-day-description", data)
+	if err != nil {
+		return Message{}, err
+	}
+	text, err := param.Templates.Render("on-this-day", data)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		Title:       day.Album.Name,
+		Description: description,
+		Text:        text,
+		URL:         link,
+		Thumbnail:   thumbnail,
+		Photos:      photos,
+	}, nil
+}
+
+// Fonction pour choisir la photo de couverture : la première favorite, sinon la première
+func coverAsset(assets []Asset) Asset {
+	for _, asset := range assets {
+		if asset.IsFavorite {
+			return asset
+		}
+	}
+	return assets[0]
+}
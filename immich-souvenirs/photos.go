@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// Dimensions maximales des photos envoyées et de leur miniature, en pixels, et taille maximale du JPEG
+const (
+	maxPhotoSide          = 1600
+	maxPhotoThumbnailSide = 100
+	maxPhotoSize          = 1024 * 1024
+)
+
+// Photo envoyée en pièce jointe, au format JPEG
+type Photo struct {
+	Data      []byte
+	Width     int
+	Height    int
+	Thumbnail []byte
+	Caption   string
+}
+
+// Fonction pour lire le nombre de photos à envoyer de WHATSAPP-PHOTOS, 0 pour n'envoyer que le lien
+func photoCount(param *Parameters) (int, error) {
+	if param.WhatsappPhotos == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(param.WhatsappPhotos)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid WHATSAPP-PHOTOS '%s'", param.WhatsappPhotos)
+	}
+	return count, nil
+}
+
+// Fonction pour récupérer les meilleures photos (les favorites, puis réparties sur toute la durée) parmi les assets, les vidéos sont ignorées
+func fetchPhotos(immichClient *ImmichClient, param *Parameters, assets []Asset, count int) ([]Photo, error) {
+	var images []Asset
+	for _, asset := range assets {
+		if asset.Type == "IMAGE" {
+			images = append(images, asset)
+		}
+	}
+
+	var photos []Photo
+	for _, asset := range selectCollageAssets(images, count) {
+		data, err := immichClient.GetThumbnail(asset.ID, SizePreview)
+		if err != nil {
+			return nil, err
+		}
+		photo, err := normalizePhoto(data)
+		if err != nil {
+			return nil, fmt.Errorf("error converting asset %s: %v", asset.ID, err)
+		}
+		photo.Caption, err = param.Templates.Render("photo-caption", TemplateData{Date: asset.FileCreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, photo)
+	}
+	return photos, nil
+}
+
+// Fonction pour convertir une image en JPEG orienté, aux dimensions et à la taille maximales, avec sa miniature
+func normalizePhoto(data []byte) (Photo, error) {
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return Photo{}, err
+	}
+	img = imaging.Fit(img, maxPhotoSide, maxPhotoSide, imaging.Lanczos)
+
+	var photo Photo
+	var buffer bytes.Buffer
+	for quality := 90; quality >= 50; quality -= 10 {
+		buffer.Reset()
+		if err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality}); err != nil {
+			return Photo{}, err
+		}
+		if buffer.Len() <= maxPhotoSize {
+			break
+		}
+	}
+	photo.Data = append([]byte(nil), buffer.Bytes()...)
+	photo.Width, photo.Height = img.Bounds().Dx(), img.Bounds().Dy()
+
+	buffer.Reset()
+	if err := jpeg.Encode(&buffer, imaging.Fit(img, maxPhotoThumbnailSide, maxPhotoThumbnailSide, imaging.Lanczos), &jpeg.Options{Quality: 60}); err != nil {
+		return Photo{}, err
+	}
+	photo.Thumbnail = buffer.Bytes()
+	return photo, nil
+}
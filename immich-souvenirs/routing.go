@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Configuration du routage, lue depuis le fichier ROUTES-FILE :
+//
+//	{
+//	  "destinations": {
+//	    "famille": {"notifier": "whatsapp", "target": "123456789@g.us"},
+//	    "grands-parents": {"notifier": "whatsapp", "target": "987654321@g.us"}
+//	  },
+//	  "routes": [
+//	    {"shared_with": ["papy@example.com", "mamie@example.com"], "destinations": ["grands-parents"]},
+//	    {"album": "^Vacances", "tag": "Famille", "destinations": ["famille"]}
+//	  ],
+//	  "default": ["famille"]
+//	}
+//
+// Un album est envoyé aux destinations de toutes les règles qu'il vérifie, ou aux destinations par défaut s'il n'en vérifie aucune.
+// Sans cible, une destination utilise la cible par défaut du canal (WHATSAPP-GROUP, TELEGRAM-CHAT-ID...).
+type RoutesConfig struct {
+	Destinations map[string]struct {
+		Notifier string `json:"notifier"`
+		Target   string `json:"target"`
+	} `json:"destinations"`
+	Routes  []*Route `json:"routes"`
+	Default []string `json:"default"`
+}
+
+// Règle de routage, tous les critères renseignés doivent être vérifiés
+type Route struct {
+	Album        string   `json:"album"`       // Expression régulière sur le nom de l'album
+	Owner        string   `json:"owner"`       // Email, nom ou identifiant du propriétaire de l'album
+	SharedWith   []string `json:"shared_with"` // Utilisateurs (email, nom ou identifiant) dont au moins un doit avoir accès à l'album
+	Tag          string   `json:"tag"`         // Tag (nom ou chemin complet) d'au moins une photo de l'album
+	Destinations []string `json:"destinations"`
+	albumRegexp  *regexp.Regexp
+}
+
+type Router struct {
+	Destinations map[string]Destination
+	Routes       []*Route
+	Default      []string
+	mutex        sync.Mutex
+	tags         []Tag // Tags d'Immich, chargés une seule fois par exécution
+	tagsLoaded   bool
+}
+
+// Fonction pour créer le routage : depuis ROUTES-FILE si renseigné, sinon tous les albums sont envoyés aux canaux listés dans NOTIFIERS
+func newRouter(param *Parameters) (*Router, error) {
+	// Chaque canal n'est créé qu'une fois, même s'il sert à plusieurs destinations
+	notifiers := make(map[string]Notifier)
+	defaultTargets := make(map[string]string)
+	getNotifier := func(name string) (Notifier, string, error) {
+		if notifier, ok := notifiers[name]; ok {
+			return notifier, defaultTargets[name], nil
+		}
+		notifier, target, err := newNotifier(name, param)
+		if err != nil {
+			return nil, "", fmt.Errorf("notifier '%s': %v", name, err)
+		}
+		notifiers[name], defaultTargets[name] = notifier, target
+		return notifier, target, nil
+	}
+
+	router := &Router{Destinations: make(map[string]Destination)}
+	if param.RoutesFile == "" {
+		for _, name := range splitList(param.Notifiers) {
+			notifier, target, err := getNotifier(name)
+			if err != nil {
+				return nil, err
+			}
+			router.Destinations[name] = Destination{Name: name, Notifier: notifier, Target: target}
+			router.Default = append(router.Default, name)
+		}
+		if len(router.Default) == 0 {
+			return nil, fmt.Errorf("no notifier configured")
+		}
+		return router, nil
+	}
+
+	data, err := os.ReadFile(param.RoutesFile)
+	if err != nil {
+		return nil, err
+	}
+	var config RoutesConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid routes file '%s': %v", param.RoutesFile, err)
+	}
+	for name, destination := range config.Destinations {
+		notifier, target, err := getNotifier(destination.Notifier)
+		if err != nil {
+			return nil, fmt.Errorf("destination '%s': %v", name, err)
+		}
+		if destination.Target != "" {
+			target = destination.Target
+		}
+		router.Destinations[name] = Destination{Name: name, Notifier: notifier, Target: target}
+	}
+	for i, route := range config.Routes {
+		if len(route.Destinations) == 0 {
+			return nil, fmt.Errorf("route %d: no destination", i+1)
+		}
+		if err := router.checkDestinations(route.Destinations); err != nil {
+			return nil, fmt.Errorf("route %d: %v", i+1, err)
+		}
+		if route.Album != "" {
+			route.albumRegexp, err = regexp.Compile(route.Album)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid album expression: %v", i+1, err)
+			}
+		}
+	}
+	if err := router.checkDestinations(config.Default); err != nil {
+		return nil, fmt.Errorf("default: %v", err)
+	}
+	router.Routes, router.Default = config.Routes, config.Default
+	return router, nil
+}
+
+func (router *Router) checkDestinations(names []string) error {
+	for _, name := range names {
+		if _, ok := router.Destinations[name]; !ok {
+			return fmt.Errorf("unknown destination '%s'", name)
+		}
+	}
+	return nil
+}
+
+// Méthode pour obtenir toutes les destinations, triées par nom
+func (router *Router) All() []Destination {
+	var destinations []Destination
+	for _, destination := range router.Destinations {
+		destinations = append(destinations, destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool { return destinations[i].Name < destinations[j].Name })
+	return destinations
+}
+
+// Méthode pour obtenir les destinations d'un album
+func (router *Router) Route(album Album, immichClient *ImmichClient) ([]Destination, error) {
+	var names []string
+	for _, route := range router.Routes {
+		matched, err := route.matches(album, immichClient, router)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			names = append(names, route.Destinations...)
+		}
+	}
+	if len(names) == 0 {
+		names = router.Default
+	}
+
+	var destinations []Destination
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			destinations = append(destinations, router.Destinations[name])
+		}
+	}
+	return destinations, nil
+}
+
+// Méthode pour oublier les tags chargés, ils sont rechargés au premier routage de l'exécution suivante
+func (router *Router) ResetTags() {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	router.tags, router.tagsLoaded = nil, false
+}
+
+// Méthode pour obtenir les identifiants des tags ayant ce nom ou ce chemin complet, plusieurs tags pouvant avoir le même nom
+func (router *Router) tagIDs(immichClient *ImmichClient, name string) ([]string, error) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+	if !router.tagsLoaded {
+		tags, err := immichClient.FetchTags()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching tags: %v", err)
+		}
+		router.tags, router.tagsLoaded = tags, true
+	}
+	var ids []string
+	for _, tag := range router.tags {
+		if tag.Value == name || tag.Name == name {
+			ids = append(ids, tag.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Méthode pour vérifier si un album satisfait la règle, le tag est vérifié en dernier car il nécessite d'interroger Immich
+func (route *Route) matches(album Album, immichClient *ImmichClient, router *Router) (bool, error) {
+	if route.albumRegexp != nil && !route.albumRegexp.MatchString(album.Name) {
+		return false, nil
+	}
+	if route.Owner != "" && !matchUser(album.Owner, route.Owner) {
+		return false, nil
+	}
+	if len(route.SharedWith) > 0 {
+		shared := false
+		for _, albumUser := range album.AlbumUsers {
+			for _, user := range route.SharedWith {
+				if matchUser(albumUser.User, user) {
+					shared = true
+				}
+			}
+		}
+		if !shared {
+			return false, nil
+		}
+	}
+	if route.Tag != "" {
+		// Les souvenirs du jour ne sont pas des albums Immich
+		if album.Owner.ID == "" {
+			return false, nil
+		}
+		tagIDs, err := router.tagIDs(immichClient, route.Tag)
+		if err != nil {
+			return false, err
+		}
+		for _, tagID := range tagIDs {
+			hasTag, err := immichClient.AlbumHasTag(album.ID, tagID)
+			if err != nil || hasTag {
+				return hasTag, err
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// Fonction pour vérifier si un utilisateur correspond à son email, son nom ou son identifiant
+func matchUser(user User, reference string) bool {
+	return strings.EqualFold(user.Email, reference) || user.Name == reference || user.ID == reference
+}
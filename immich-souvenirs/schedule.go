@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Les messages à envoyer lors d'une exécution
+type Jobs struct {
+	Anniversaries bool
+	NewAlbums     bool
+	OnThisDay     bool
+	Digest        bool
+}
+
+// Les messages envoyés à TIME-TO-RUN
+var defaultJobs = Jobs{Anniversaries: true, NewAlbums: true}
+
+// Fonction pour lire une liste de tâches séparées par des virgules : anniversaries, new-albums, on-this-day, digest ou all (tout sauf le résumé)
+func parseJobs(list string) (Jobs, error) {
+	var jobs Jobs
+	for _, name := range splitList(list) {
+		switch name {
+		case "anniversaries":
+			jobs.Anniversaries = true
+		case "new-albums":
+			jobs.NewAlbums = true
+		case "on-this-day":
+			jobs.OnThisDay = true
+		case "digest":
+			jobs.Digest = true
+		case "all":
+			jobs.Anniversaries, jobs.NewAlbums, jobs.OnThisDay = true, true, true
+		default:
+			return jobs, fmt.Errorf("unknown job '%s'", name)
+		}
+	}
+	if jobs == (Jobs{}) {
+		return jobs, fmt.Errorf("no job given")
+	}
+	return jobs, nil
+}
+
+func (jobs Jobs) String() string {
+	var names []string
+	if jobs.Anniversaries {
+		names = append(names, "anniversaries")
+	}
+	if jobs.NewAlbums {
+		names = append(names, "new-albums")
+	}
+	if jobs.OnThisDay {
+		names = append(names, "on-this-day")
+	}
+	if jobs.Digest {
+		names = append(names, "digest")
+	}
+	return strings.Join(names, ",")
+}
+
+// Planification d'une exécution
+type Schedule struct {
+	Spec string // Expression cron standard (minute heure jour mois jour-de-la-semaine) ou @daily, @weekly...
+	Jobs Jobs
+}
+
+// Fonction pour lire les planifications de SCHEDULES, séparées par des points-virgules, comme :
+//
+//	anniversaries=0 8 * * *; new-albums=0 20 * * *; digest=0 9 * * 1
+//
+// Sans SCHEDULES, les anniversaires et les nouveaux albums sont envoyés chaque jour à TIME-TO-RUN (HH:MM).
+func parseSchedules(param *Parameters) ([]Schedule, error) {
+	if strings.TrimSpace(param.Schedules) == "" {
+		hours, minutes, err := parseTime(param.TimeToRun)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time format: %v", err)
+		}
+		if hours < 0 || hours > 23 || minutes < 0 || minutes > 59 {
+			return nil, fmt.Errorf("invalid time: %s", param.TimeToRun)
+		}
+		return []Schedule{{Spec: fmt.Sprintf("%d %d * * *", minutes, hours), Jobs: defaultJobs}}, nil
+	}
+
+	var schedules []Schedule
+	for _, item := range strings.Split(param.Schedules, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		list, spec, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule '%s', it must look like jobs=cron expression", item)
+		}
+		jobs, err := parseJobs(list)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", item, err)
+		}
+		spec = strings.TrimSpace(spec)
+		if _, err := cron.ParseStandard(spec); err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", item, err)
+		}
+		schedules = append(schedules, Schedule{Spec: spec, Jobs: jobs})
+	}
+	return schedules, nil
+}
+
+// Fonction pour obtenir l'ensemble des messages envoyés par les planifications
+func scheduledJobs(schedules []Schedule) Jobs {
+	var jobs Jobs
+	for _, schedule := range schedules {
+		jobs.Anniversaries = jobs.Anniversaries || schedule.Jobs.Anniversaries
+		jobs.NewAlbums = jobs.NewAlbums || schedule.Jobs.NewAlbums
+		jobs.OnThisDay = jobs.OnThisDay || schedule.Jobs.OnThisDay
+		jobs.Digest = jobs.Digest || schedule.Jobs.Digest
+	}
+	return jobs
+}
+
+// Fonction pour obtenir le fuseau horaire des planifications : TZ, sinon le fuseau local
+func loadLocation(param *Parameters) (*time.Location, error) {
+	if param.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(param.TimeZone)
+}
+
+// Fonction pour démarrer les planifications, run est appelé à chaque échéance.
+// Les heures sont calculées dans le fuseau horaire location, y compris lors des changements d'heure.
+func startScheduler(schedules []Schedule, location *time.Location, run func(Jobs)) (*cron.Cron, error) {
+	scheduler := cron.New(cron.WithLocation(location))
+	now := time.Now().In(location)
+	for _, schedule := range schedules {
+		jobs := schedule.Jobs
+		id, err := scheduler.AddFunc(schedule.Spec, func() { run(jobs) })
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule '%s': %v", schedule.Spec, err)
+		}
+		fmt.Printf("Next run of %s (%s): %v\n", jobs, schedule.Spec, scheduler.Entry(id).Schedule.Next(now))
+	}
+	scheduler.Start()
+	return scheduler, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Données disponibles dans les modèles de messages
+type TemplateData struct {
+	Album       string    // Nom de l'album
+	Description string    // Description de l'album
+	YearsAgo    int       // Nombre d'années depuis le début de l'album ou la prise des photos
+	AssetCount  int       // Nombre de photos et vidéos
+	StartDate   time.Time // Date de début de l'album
+	EndDate     time.Time // Date de fin de l'album
+	Date        time.Time // Date de l'anniversaire, de création de l'album ou de prise de la photo
+	Link        string    // Lien de partage
+
+	// Seulement pour le résumé
+	Period        string // week ou month
+	AlbumCount    int
+	Anniversaries []TemplateData
+	NewAlbums     []TemplateData
+}
+
+// Modèles fournis, par langue. Les fonctions disponibles sont :
+//   - plural n "singulier" "pluriel", selon les règles de la langue
+//   - date d, au format de la langue
+//   - dateRange début fin, une seule date si elles sont le même jour
+var builtinTemplates = map[string]map[string]string{
+	"en": {
+		"anniversary":             `{{.YearsAgo}} {{plural .YearsAgo "year" "years"}} ago: {{.Link}}`,
+		"new-album":               `New album: {{.Link}}`,
+		"on-this-day-title":       `On this day in {{.Date.Year}}`,
+		"on-this-day-description": `{{.AssetCount}} {{plural .AssetCount "photo" "photos"}}`,
+		"on-this-day":             `{{.YearsAgo}} {{plural .YearsAgo "year" "years"}} ago: {{.Link}}`,
+		"digest-title":            `{{if eq .Period "month"}}This month's memories{{else}}This week's memories{{end}}`,
+		"digest-description":      `{{.AlbumCount}} {{plural .AlbumCount "album" "albums"}}`,
+		"digest": `{{if .Anniversaries}}Anniversaries:{{range .Anniversaries}}
+• {{date .Date}}: {{.Album}}, {{.YearsAgo}} {{plural .YearsAgo "year" "years"}} ago {{.Link}}{{end}}{{end}}{{if and .Anniversaries .NewAlbums}}
+
+{{end}}{{if .NewAlbums}}New albums:{{range .NewAlbums}}
+• {{.Album}} {{.Link}}{{end}}{{end}}`,
+		"photo-caption": `{{date .Date}}`,
+	},
+	"fr": {
+		"anniversary":             `Il y a {{.YearsAgo}} {{plural .YearsAgo "an" "ans"}} : {{.Link}}`,
+		"new-album":               `Nouvel album : {{.Link}}`,
+		"on-this-day-title":       `Ce jour-là en {{.Date.Year}}`,
+		"on-this-day-description": `{{.AssetCount}} {{plural .AssetCount "photo" "photos"}}`,
+		"on-this-day":             `Il y a {{.YearsAgo}} {{plural .YearsAgo "an" "ans"}} : {{.Link}}`,
+		"digest-title":            `{{if eq .Period "month"}}Les souvenirs du mois{{else}}Les souvenirs de la semaine{{end}}`,
+		"digest-description":      `{{.AlbumCount}} {{plural .AlbumCount "album" "albums"}}`,
+		"digest": `{{if .Anniversaries}}Anniversaires :{{range .Anniversaries}}
+• {{date .Date}} : {{.Album}}, il y a {{.YearsAgo}} {{plural .YearsAgo "an" "ans"}} {{.Link}}{{end}}{{end}}{{if and .Anniversaries .NewAlbums}}
+
+{{end}}{{if .NewAlbums}}Nouveaux albums :{{range .NewAlbums}}
+• {{.Album}} {{.Link}}{{end}}{{end}}`,
+		"photo-caption": `{{date .Date}}`,
+	},
+	"de": {
+		"anniversary":             `Vor {{.YearsAgo}} {{plural .YearsAgo "Jahr" "Jahren"}}: {{.Link}}`,
+		"new-album":               `Neues Album: {{.Link}}`,
+		"on-this-day-title":       `An diesem Tag im Jahr {{.Date.Year}}`,
+		"on-this-day-description": `{{.AssetCount}} {{plural .AssetCount "Foto" "Fotos"}}`,
+		"on-this-day":             `Vor {{.YearsAgo}} {{plural .YearsAgo "Jahr" "Jahren"}}: {{.Link}}`,
+		"digest-title":            `{{if eq .Period "month"}}Die Erinnerungen des Monats{{else}}Die Erinnerungen der Woche{{end}}`,
+		"digest-description":      `{{.AlbumCount}} {{plural .AlbumCount "Album" "Alben"}}`,
+		"digest": `{{if .Anniversaries}}Jahrestage:{{range .Anniversaries}}
+• {{date .Date}}: {{.Album}}, vor {{.YearsAgo}} {{plural .YearsAgo "Jahr" "Jahren"}} {{.Link}}{{end}}{{end}}{{if and .Anniversaries .NewAlbums}}
+
+{{end}}{{if .NewAlbums}}Neue Alben:{{range .NewAlbums}}
+• {{.Album}} {{.Link}}{{end}}{{end}}`,
+		"photo-caption": `{{date .Date}}`,
+	},
+}
+
+// Formats de date, par langue
+var dateFormats = map[string]string{
+	"en": "January 2, 2006",
+	"fr": "02/01/2006",
+	"de": "02.01.2006",
+}
+
+// Fonction pour choisir entre singulier et pluriel : en français, 0 et 1 sont au singulier
+func pluralFunc(language string) func(n int, one string, other string) string {
+	return func(n int, one string, other string) string {
+		if n == 1 || (language == "fr" && n == 0) {
+			return one
+		}
+		return other
+	}
+}
+
+type Templates struct {
+	templates map[string]*template.Template
+}
+
+// Fonction pour charger les modèles de la langue MESSAGE-LANGUAGE (fr par défaut), remplacés par ceux de TEMPLATES-FILE s'il est renseigné.
+// La langue peut être donnée comme une locale (fr_FR.UTF-8) ou une liste de langues à la gettext (fr_FR:fr), seule la première est utilisée.
+// Ce fichier JSON associe le nom des modèles à remplacer à leur texte, comme {"new-album": "Un nouvel album : {{.Album}} {{.Link}}"}.
+func loadTemplates(param *Parameters) (*Templates, error) {
+	language, _, _ := strings.Cut(param.Language, ":")
+	language, _, _ = strings.Cut(language, ".")
+	language, _, _ = strings.Cut(strings.ReplaceAll(language, "-", "_"), "_")
+	language = strings.ToLower(strings.TrimSpace(language))
+	if language == "" {
+		language = "fr"
+	}
+	builtin, ok := builtinTemplates[language]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MESSAGE-LANGUAGE '%s', it must be en, fr or de", param.Language)
+	}
+	texts := make(map[string]string)
+	for name, text := range builtin {
+		texts[name] = text
+	}
+
+	if param.TemplatesFile != "" {
+		data, err := os.ReadFile(param.TemplatesFile)
+		if err != nil {
+			return nil, err
+		}
+		var custom map[string]string
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return nil, fmt.Errorf("invalid templates file '%s': %v", param.TemplatesFile, err)
+		}
+		for name, text := range custom {
+			if _, ok := texts[name]; !ok {
+				return nil, fmt.Errorf("unknown template '%s' in '%s'", name, param.TemplatesFile)
+			}
+			texts[name] = text
+		}
+	}
+
+	dateFormat := dateFormats[language]
+	date := func(d time.Time) string { return d.Format(dateFormat) }
+	funcs := template.FuncMap{
+		"plural": pluralFunc(language),
+		"date":   date,
+		"dateRange": func(start time.Time, end time.Time) string {
+			if date(start) == date(end) {
+				return date(start)
+			}
+			return date(start) + " - " + date(end)
+		},
+	}
+	templates := &Templates{templates: make(map[string]*template.Template)}
+	for name, text := range texts {
+		tmpl, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template '%s': %v", name, err)
+		}
+		templates.templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// Méthode pour produire un message à partir de son modèle
+func (t *Templates) Render(name string, data TemplateData) (string, error) {
+	var buffer bytes.Buffer
+	if err := t.templates[name].Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("erreur modèle '%s': %v", name, err)
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// Fonction pour obtenir les données d'un album pour les modèles
+func albumData(album Album, link string, date time.Time) TemplateData {
+	return TemplateData{
+		Album:       album.Name,
+		Description: album.Description,
+		YearsAgo:    date.Year() - album.StartDate.Year(),
+		AssetCount:  album.AssetCount,
+		StartDate:   album.StartDate,
+		EndDate:     album.EndDate,
+		Date:        date,
+		Link:        link,
+	}
+}